@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// aliasMap rewrites recipient addresses to the mailboxes they are delivered
+// to. An alias may expand to several targets, and targets may themselves be
+// aliases. An alias that lists itself as a target is delivered to as well as
+// expanded, as in Postfix.
+type aliasMap struct {
+	caseSensitiveLocalPart bool
+	// expansions maps a normalized alias to its fully expanded targets.
+	expansions map[string][]string
+}
+
+// readAliasFile returns the aliases in an alias file and their targets. Files
+// ending in .yaml or .yml are read as YAML, anything else in the Postfix
+// virtual format.
+func readAliasFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open alias file: %w", err)
+	}
+	defer f.Close()
+
+	var aliases map[string][]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		aliases, err = parseYAMLAliases(f)
+	default:
+		aliases, err = parseVirtualAliases(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse alias file %q: %w", path, err)
+	}
+	return aliases, nil
+}
+
+// parseVirtualAliases parses aliases in the Postfix virtual format: one alias
+// per line followed by its targets, separated by whitespace or commas. Blank
+// lines and lines starting with # are ignored, and a line starting with
+// whitespace continues the previous one.
+//
+//	sales@example.com    alice@example.com, bob@example.com
+//	info@example.com     alice@example.com
+func parseVirtualAliases(r io.Reader) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	var lines []string
+	var lineNumbers []int
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("line %d: continuation without an alias", n)
+			}
+			lines[len(lines)-1] += " " + trimmed
+			continue
+		}
+		lines = append(lines, trimmed)
+		lineNumbers = append(lineNumbers, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, line := range lines {
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: alias %q has no targets", lineNumbers[i], fields[0])
+		}
+		if _, ok := aliases[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: alias %q is defined more than once", lineNumbers[i], fields[0])
+		}
+		aliases[fields[0]] = fields[1:]
+	}
+	return aliases, nil
+}
+
+// parseYAMLAliases parses aliases from a YAML mapping of alias to targets.
+//
+//	sales@example.com: [alice@example.com, bob@example.com]
+//	info@example.com: alice@example.com
+func parseYAMLAliases(r io.Reader) (map[string][]string, error) {
+	var doc map[string]stringList
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	aliases := make(map[string][]string, len(doc))
+	for alias, targets := range doc {
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("alias %q has no targets", alias)
+		}
+		aliases[alias] = targets
+	}
+	return aliases, nil
+}
+
+// newAliasMap expands every alias up front, so that a loop is reported when
+// the aliases are loaded rather than when mail arrives.
+func newAliasMap(aliases map[string][]string, caseSensitiveLocalPart bool) (*aliasMap, error) {
+	a := &aliasMap{
+		caseSensitiveLocalPart: caseSensitiveLocalPart,
+		expansions:             make(map[string][]string, len(aliases)),
+	}
+
+	targets := make(map[string][]string, len(aliases))
+	for alias, aliasTargets := range aliases {
+		key := a.normalize(alias)
+		if !strings.Contains(key, "@") {
+			return nil, fmt.Errorf("alias %q is not an email address", alias)
+		}
+		if _, ok := targets[key]; ok {
+			return nil, fmt.Errorf("alias %q is defined more than once", alias)
+		}
+		targets[key] = Map(aliasTargets, strings.TrimSpace)
+	}
+
+	for alias := range targets {
+		expanded, err := a.expand(targets, alias, nil)
+		if err != nil {
+			return nil, err
+		}
+		a.expansions[alias] = expanded
+	}
+	return a, nil
+}
+
+// expand returns the mailboxes alias is delivered to. path holds the aliases
+// being expanded, outermost first, to detect loops.
+func (a *aliasMap) expand(targets map[string][]string, alias string, path []string) ([]string, error) {
+	if Contains(path, alias) {
+		return nil, fmt.Errorf("alias loop: %s -> %s", strings.Join(path, " -> "), alias)
+	}
+	path = append(path, alias)
+
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, target := range targets[alias] {
+		key := a.normalize(target)
+		var mailboxes []string
+		if _, ok := targets[key]; ok && key != alias {
+			var err error
+			mailboxes, err = a.expand(targets, key, path)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			mailboxes = []string{target}
+		}
+		for _, mailbox := range mailboxes {
+			if key := a.normalize(mailbox); !seen[key] {
+				seen[key] = true
+				expanded = append(expanded, mailbox)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+func (a *aliasMap) normalize(address string) string {
+	return normalizeAddress(address, a.caseSensitiveLocalPart)
+}
+
+// Expand returns the mailboxes address is delivered to, and whether it is an
+// alias at all. It is safe to call on a nil aliasMap.
+func (a *aliasMap) Expand(address string) ([]string, bool) {
+	if a == nil {
+		return nil, false
+	}
+	expanded, ok := a.expansions[a.normalize(strings.TrimSpace(address))]
+	return expanded, ok
+}
+
+// Len returns the number of aliases.
+func (a *aliasMap) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.expansions)
+}
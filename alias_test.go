@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVirtualAliases(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string][]string
+		expectErr bool
+	}{
+		{
+			name: "aliases, comments and continuations",
+			input: `# Sales team
+sales@example.com    alice@example.com, bob@example.com
+info@example.com	alice@example.com
+
+billing@example.com  carol@example.com,
+    dave@example.com
+`,
+			expected: map[string][]string{
+				"sales@example.com":   {"alice@example.com", "bob@example.com"},
+				"info@example.com":    {"alice@example.com"},
+				"billing@example.com": {"carol@example.com", "dave@example.com"},
+			},
+		},
+		{
+			name:      "alias without targets",
+			input:     "sales@example.com\n",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate alias",
+			input:     "sales@example.com alice@example.com\nsales@example.com bob@example.com\n",
+			expectErr: true,
+		},
+		{
+			name:      "continuation without an alias",
+			input:     "  alice@example.com\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseVirtualAliases(strings.NewReader(tt.input))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseVirtualAliases() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseVirtualAliases() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseYAMLAliases(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string][]string
+		expectErr bool
+	}{
+		{
+			name: "single and multiple targets",
+			input: `sales@example.com: [alice@example.com, bob@example.com]
+info@example.com: alice@example.com
+`,
+			expected: map[string][]string{
+				"sales@example.com": {"alice@example.com", "bob@example.com"},
+				"info@example.com":  {"alice@example.com"},
+			},
+		},
+		{
+			name:     "empty file",
+			input:    "",
+			expected: map[string][]string{},
+		},
+		{
+			name:      "alias without targets",
+			input:     "sales@example.com: []\n",
+			expectErr: true,
+		},
+		{
+			name:      "not a mapping",
+			input:     "- sales@example.com\n",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseYAMLAliases(strings.NewReader(tt.input))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseYAMLAliases() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseYAMLAliases() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAliasMapExpand(t *testing.T) {
+	aliases, err := newAliasMap(map[string][]string{
+		"sales@example.com":   {"alice@example.com", "team@example.com"},
+		"team@example.com":    {"bob@example.com", "Alice@example.com"},
+		"info@example.com":    {"info@example.com", "carol@example.com"},
+		"Billing@Example.com": {"dave@example.com"},
+	}, false)
+	if err != nil {
+		t.Fatalf("newAliasMap() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		address  string
+		expected []string
+		isAlias  bool
+	}{
+		{
+			name:     "nested aliases",
+			address:  "sales@example.com",
+			expected: []string{"alice@example.com", "bob@example.com"},
+			isAlias:  true,
+		},
+		{
+			name:     "alias delivered to itself",
+			address:  "info@example.com",
+			expected: []string{"info@example.com", "carol@example.com"},
+			isAlias:  true,
+		},
+		{
+			name:     "case-insensitive alias",
+			address:  "BILLING@example.COM",
+			expected: []string{"dave@example.com"},
+			isAlias:  true,
+		},
+		{
+			name:    "not an alias",
+			address: "alice@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := aliases.Expand(tt.address)
+			if ok != tt.isAlias {
+				t.Fatalf("Expand() ok = %v, want %v", ok, tt.isAlias)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expand() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewAliasMapLoop(t *testing.T) {
+	_, err := newAliasMap(map[string][]string{
+		"a@example.com": {"b@example.com"},
+		"b@example.com": {"c@example.com"},
+		"c@example.com": {"A@example.com"},
+	}, false)
+	if err == nil || !strings.Contains(err.Error(), "alias loop") {
+		t.Errorf("newAliasMap() error = %v, want an alias loop", err)
+	}
+}
+
+func TestReadAliasFile(t *testing.T) {
+	dir := t.TempDir()
+	virtualFile := filepath.Join(dir, "virtual")
+	yamlFile := filepath.Join(dir, "aliases.yaml")
+	if err := os.WriteFile(virtualFile, []byte("sales@example.com alice@example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(yamlFile, []byte("sales@example.com: alice@example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{virtualFile, yamlFile} {
+		result, err := readAliasFile(path)
+		if err != nil {
+			t.Fatalf("readAliasFile(%q) error = %v", path, err)
+		}
+		expected := map[string][]string{"sales@example.com": {"alice@example.com"}}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("readAliasFile(%q) = %v, want %v", path, result, expected)
+		}
+	}
+
+	if _, err := readAliasFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("readAliasFile() error = nil, want an error for a missing file")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// markerFile records which stored emails have been delivered, one bucket/key
+// per line, so that the backfill scanner doesn't deliver them again. It also
+// records emails that failed permanently, as "failed" and the bucket/key, and
+// leases, as lines of "lease", an RFC 3339 time and the bucket/key, for emails
+// an SQS message will be retried for. The first line records when the file
+// was started, as "since" and an RFC 3339 time. Lines are only ever appended.
+type markerFile struct {
+	mu     sync.Mutex
+	file   *os.File
+	since  time.Time
+	keys   map[string]bool
+	failed map[string]bool
+	leases map[string]time.Time
+}
+
+// Prefixes of the lines recording when the file was started, failures and
+// leases. Bucket names can't contain spaces, so they can't be mistaken for
+// delivered emails.
+const (
+	markerSincePrefix  = "since "
+	markerFailedPrefix = "failed "
+	markerLeasePrefix  = "lease "
+)
+
+// openMarkerFile reads the keys recorded in the file at path, creating it if
+// it doesn't exist, and opens it to record more. A file that doesn't record
+// when it was started is taken to start now.
+func openMarkerFile(path string) (*markerFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open marker file: %w", err)
+	}
+
+	m := &markerFile{file: file, keys: make(map[string]bool), failed: make(map[string]bool), leases: make(map[string]time.Time)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if since, ok := strings.CutPrefix(line, markerSincePrefix); ok {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("invalid start time in marker file: %q", line)
+			}
+			m.since = t
+			continue
+		}
+		if key, ok := strings.CutPrefix(line, markerFailedPrefix); ok {
+			m.failed[key] = true
+			continue
+		}
+		if lease, ok := strings.CutPrefix(line, markerLeasePrefix); ok {
+			until, key, _ := strings.Cut(lease, " ")
+			t, err := time.Parse(time.RFC3339, until)
+			if err != nil || key == "" {
+				file.Close()
+				return nil, fmt.Errorf("invalid lease in marker file: %q", line)
+			}
+			m.leases[key] = t
+			continue
+		}
+		if line != "" {
+			m.keys[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read marker file: %w", err)
+	}
+
+	if m.since.IsZero() {
+		m.since = time.Now().UTC().Truncate(time.Second)
+		if _, err := fmt.Fprintln(file, markerSincePrefix+m.since.Format(time.RFC3339)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write marker file: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// Since returns when the file started recording processed emails. Emails
+// stored before then may have been delivered without being recorded.
+func (m *markerFile) Since() time.Time {
+	return m.since
+}
+
+// Has reports whether the email at key in bucket has been delivered.
+func (m *markerFile) Has(bucket, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[bucket+"/"+key]
+}
+
+// Mark records that the email at key in bucket has been delivered.
+func (m *markerFile) Mark(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marker := bucket + "/" + key
+	if m.keys[marker] {
+		return nil
+	}
+	if _, err := fmt.Fprintln(m.file, marker); err != nil {
+		return fmt.Errorf("failed to write marker file: %w", err)
+	}
+	m.keys[marker] = true
+	return nil
+}
+
+// Fail records that the email at key in bucket failed permanently. The
+// backfill scanner doesn't try it again, but an SQS message for it is still
+// processed, as the cause may have been fixed by the time it comes back.
+func (m *markerFile) Fail(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marker := bucket + "/" + key
+	if m.failed[marker] {
+		return nil
+	}
+	if _, err := fmt.Fprintln(m.file, markerFailedPrefix+marker); err != nil {
+		return fmt.Errorf("failed to write marker file: %w", err)
+	}
+	m.failed[marker] = true
+	return nil
+}
+
+// Failed reports whether the email at key in bucket failed permanently.
+func (m *markerFile) Failed(bucket, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed[bucket+"/"+key]
+}
+
+// Lease records that an SQS message for the email at key in bucket is due to
+// be retried by until, so the backfill scanner should leave it alone.
+func (m *markerFile) Lease(bucket, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marker := bucket + "/" + key
+	if _, err := fmt.Fprintln(m.file, markerLeasePrefix+until.UTC().Format(time.RFC3339)+" "+marker); err != nil {
+		return fmt.Errorf("failed to write marker file: %w", err)
+	}
+	m.leases[marker] = until
+	return nil
+}
+
+// Leased reports whether the email at key in bucket is leased to an SQS
+// message at now.
+func (m *markerFile) Leased(bucket, key string, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return now.Before(m.leases[bucket+"/"+key])
+}
+
+// Len returns the number of delivered emails recorded.
+func (m *markerFile) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.keys)
+}
+
+func (m *markerFile) Close() error {
+	return m.file.Close()
+}
+
+// backfiller delivers the emails in the SES bucket that haven't been processed
+// yet, such as those stored while the queue or its SNS subscription was
+// misconfigured.
+type backfiller struct {
+	pipeline *emailPipeline
+	client   s3.ListObjectsV2APIClient
+	cfg      BackfillConfig
+	now      func() time.Time
+}
+
+// backfillResult counts the outcome of a scan.
+type backfillResult struct {
+	found, delivered, failed int
+}
+
+// scan lists the bucket and delivers every email that isn't marked as
+// processed, stopping early if ctx is cancelled. Deliveries that have started
+// are finished regardless.
+func (b *backfiller) scan(ctx context.Context) (backfillResult, error) {
+	var result backfillResult
+	markers := b.pipeline.markers
+	// Without an explicit start, emails from before the marker file existed
+	// are assumed to have been delivered
+	since := b.cfg.Since
+	if since.IsZero() {
+		since = markers.Since()
+	}
+	end := b.now().Add(-b.cfg.MinAge)
+	if !end.After(since) {
+		return result, nil
+	}
+	keys, err := listReplayKeys(ctx, b.client, b.cfg.Bucket, b.cfg.Prefix, since, end)
+	if err != nil {
+		return result, fmt.Errorf("failed to list bucket: %w", err)
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		if markers.Has(b.cfg.Bucket, key) || markers.Failed(b.cfg.Bucket, key) {
+			continue
+		}
+		if markers.Leased(b.cfg.Bucket, key, b.now()) {
+			slog.Info("leaving email to the sqs message that will retry it", "bucket", b.cfg.Bucket, "key", key)
+			continue
+		}
+		result.found++
+
+		logger := slog.With("bucket", b.cfg.Bucket, "key", key)
+		logger.Info("backfilling email")
+		recipients, err := b.pipeline.deliverStored(context.WithoutCancel(ctx), b.cfg.Bucket, key, nil)
+		b.pipeline.markProcessed(b.cfg.Bucket, key, err)
+		if err != nil {
+			result.failed++
+			logger.Error("failed to backfill email", "err", err, "retryable", isRetryable(err))
+			continue
+		}
+		result.delivered++
+		logger.Info("backfilled email", "recipients", recipients)
+	}
+	return result, nil
+}
+
+// run scans the bucket straight away and then every interval until ctx is
+// cancelled.
+func (b *backfiller) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		slog.Info("scanning bucket for undelivered emails", "bucket", b.cfg.Bucket, "prefix", b.cfg.Prefix)
+		result, err := b.scan(ctx)
+		if err != nil {
+			slog.Error("failed to scan bucket", "bucket", b.cfg.Bucket, "err", err)
+		} else {
+			slog.Info("scanned bucket", "bucket", b.cfg.Bucket, "found", result.found, "delivered", result.delivered, "failed", result.failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backfillCommand scans the configured bucket once, delivering every email
+// that hasn't been processed yet.
+func backfillCommand(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("backfill", stderr)
+	configPath := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+	if cfg.Backfill.Bucket == "" {
+		fmt.Fprintln(stderr, "no bucket to backfill from, set backfill.bucket (BACKFILL_BUCKET)")
+		return 2
+	}
+	resolver, err := newRecipientResolver(cfg.Recipients)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+	deliver := newDeliverer
+	if cfg.DryRun.Enabled {
+		deliver = newDryRunDeliverer
+	}
+	deliverer, err := deliver(cfg.Delivery)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to configure delivery: %v\n", err)
+		return 1
+	}
+	live := newLiveConfig(*configPath, os.LookupEnv, cfg, resolver, deliverer)
+	defer func() {
+		if err := live.Close(); err != nil {
+			slog.Error("failed to close deliverer", "err", err)
+		}
+	}()
+	markers, err := openMarkerFile(cfg.Backfill.MarkerFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer markers.Close()
+
+	// Stop after the current email on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load aws config: %v\n", err)
+		return 1
+	}
+	s3Client := s3.NewFromConfig(awsConfig)
+
+	b := &backfiller{
+		pipeline: &emailPipeline{
+			live:     live,
+			s3Client: s3Client,
+			ledger:   newDeliveryLedger(24 * time.Hour),
+			dryRun:   cfg.DryRun.Enabled,
+			markers:  markers,
+		},
+		client: s3Client,
+		cfg:    cfg.Backfill,
+		now:    time.Now,
+	}
+	result, err := b.scan(ctx)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "backfilled %d of %d unprocessed emails from s3://%s/%s, %d failed\n", result.delivered, result.found, cfg.Backfill.Bucket, cfg.Backfill.Prefix, result.failed)
+	if result.failed > 0 || ctx.Err() != nil {
+		return 1
+	}
+	return 0
+}
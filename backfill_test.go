@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	smtp "github.com/emersion/go-smtp"
+)
+
+func TestMarkerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "processed")
+	markers, err := openMarkerFile(path)
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	if markers.Has("mail", "inbound/a") {
+		t.Errorf("Has() = true before Mark()")
+	}
+	for _, key := range []string{"inbound/a", "inbound/b", "inbound/a"} {
+		if err := markers.Mark("mail", key); err != nil {
+			t.Fatalf("Mark() error = %v", err)
+		}
+	}
+	if !markers.Has("mail", "inbound/a") {
+		t.Errorf("Has() = false after Mark()")
+	}
+	if err := markers.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read marker file: %v", err)
+	}
+	expected := "since " + markers.Since().Format(time.RFC3339) + "\nmail/inbound/a\nmail/inbound/b\n"
+	if markers.Since().IsZero() || string(content) != expected {
+		t.Errorf("marker file = %q, want %q", content, expected)
+	}
+
+	reopened, err := openMarkerFile(path)
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	if !reopened.Has("mail", "inbound/b") || reopened.Len() != 2 {
+		t.Errorf("reopened marker file has %d keys, want the 2 marked before", reopened.Len())
+	}
+	if !reopened.Since().Equal(markers.Since()) {
+		t.Errorf("reopened Since() = %v, want %v", reopened.Since(), markers.Since())
+	}
+
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	if err := reopened.Lease("mail", "inbound/with space", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Lease() error = %v", err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	leased, err := openMarkerFile(path)
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	if !leased.Leased("mail", "inbound/with space", now) {
+		t.Errorf("Leased() = false before the lease ends")
+	}
+	if leased.Leased("mail", "inbound/with space", now.Add(2*time.Hour)) || leased.Leased("mail", "inbound/a", now) {
+		t.Errorf("Leased() = true after the lease ended or without a lease")
+	}
+	if leased.Has("mail", "inbound/with space") || leased.Len() != 2 {
+		t.Errorf("a lease was read as a processed email")
+	}
+
+	if err := leased.Fail("mail", "inbound/c"); err != nil {
+		t.Fatalf("Fail() error = %v", err)
+	}
+	if err := leased.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	failed, err := openMarkerFile(path)
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	defer failed.Close()
+	if !failed.Failed("mail", "inbound/c") || failed.Failed("mail", "inbound/a") {
+		t.Errorf("Failed() doesn't match the email that failed")
+	}
+	if failed.Has("mail", "inbound/c") || failed.Len() != 2 {
+		t.Errorf("a failure was read as a processed email")
+	}
+}
+
+func TestBackfillerScan(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	email := func(to string) string {
+		return "From: sender@example.net\r\nTo: " + to + "\r\n\r\nbody\r\n"
+	}
+	client := &fakeReplayS3{pageSize: 10, objects: map[string]fakeReplayObject{
+		"inbound/old":       {body: email("a@example.com"), modified: now.Add(-30 * 24 * time.Hour)},
+		"inbound/processed": {body: email("a@example.com"), modified: now.Add(-2 * time.Hour)},
+		"inbound/missed":    {body: email("a@example.com"), modified: now.Add(-time.Hour)},
+		"inbound/transient": {body: email("down@example.com"), modified: now.Add(-time.Hour)},
+		"inbound/malformed": {body: "From: sender@example.net\r\n\r\nbody\r\n", modified: now.Add(-time.Hour)},
+		"inbound/recent":    {body: email("a@example.com"), modified: now.Add(-time.Minute)},
+		"inbound/leased":    {body: email("a@example.com"), modified: now.Add(-time.Hour)},
+	}}
+
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"a@example.com", "down@example.com"},
+		DefaultMailbox: "a@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{errs: map[string]error{"down@example.com": errors.New("connection refused")}}
+	markers, err := openMarkerFile(filepath.Join(t.TempDir(), "processed"))
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	defer markers.Close()
+	if err := markers.Mark("mail", "inbound/processed"); err != nil {
+		t.Fatalf("Mark() error = %v", err)
+	}
+	if err := markers.Lease("mail", "inbound/leased", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Lease() error = %v", err)
+	}
+
+	b := &backfiller{
+		pipeline: &emailPipeline{
+			live:     newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+			s3Client: client,
+			ledger:   newDeliveryLedger(time.Hour),
+			markers:  markers,
+		},
+		client: client,
+		cfg: BackfillConfig{
+			Bucket: "mail",
+			Prefix: "inbound/",
+			Since:  now.Add(-7 * 24 * time.Hour),
+			MinAge: 15 * time.Minute,
+		},
+		now: func() time.Time { return now },
+	}
+
+	result, err := b.scan(context.Background())
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	expected := backfillResult{found: 3, delivered: 1, failed: 2}
+	if result != expected {
+		t.Errorf("scan() = %+v, want %+v", result, expected)
+	}
+	expectedCalls := [][]string{{"a@example.com"}, {"down@example.com"}}
+	if !reflect.DeepEqual(deliverer.calls, expectedCalls) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expectedCalls)
+	}
+	for key, marked := range map[string]bool{
+		"inbound/missed":    true,
+		"inbound/malformed": false,
+		"inbound/transient": false,
+		"inbound/recent":    false,
+	} {
+		if result := markers.Has("mail", key); result != marked {
+			t.Errorf("Has(%q) = %v, want %v", key, result, marked)
+		}
+	}
+	if !markers.Failed("mail", "inbound/malformed") || markers.Failed("mail", "inbound/transient") {
+		t.Errorf("Failed() doesn't match the emails that failed permanently")
+	}
+
+	// Only the email that failed transiently is tried again
+	deliverer.calls = nil
+	result, err = b.scan(context.Background())
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	expected = backfillResult{found: 1, failed: 1}
+	if result != expected {
+		t.Errorf("second scan() = %+v, want %+v", result, expected)
+	}
+}
+
+func TestBackfillCommandRequiresBucket(t *testing.T) {
+	t.Setenv("SQS_QUEUE_URL", "https://sqs.us-east-1.amazonaws.com/123456789012/inbound")
+	t.Setenv("MAILBOXES", "user@example.com")
+	t.Setenv("DEFAULT_MAILBOX", "user@example.com")
+	t.Setenv("LMTP_HOST", "mail:24")
+	t.Setenv("LMTP_FROM", "ses@example.com")
+	t.Setenv("SNS_TOPIC_ARNS", "arn:aws:sns:us-east-1:123456789012:ses-inbound")
+
+	var stdout, stderr strings.Builder
+	if status := backfillCommand(nil, &stdout, &stderr); status != 2 {
+		t.Errorf("backfillCommand() = %v, want %v", status, 2)
+	}
+	if !strings.Contains(stderr.String(), "BACKFILL_BUCKET") {
+		t.Errorf("backfillCommand() stderr = %q, want it to mention BACKFILL_BUCKET", stderr.String())
+	}
+}
+
+func TestMessageProcessorSharesMarkersWithBackfill(t *testing.T) {
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"user@example.com"},
+		DefaultMailbox: "user@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	markers, err := openMarkerFile(filepath.Join(t.TempDir(), "processed"))
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	defer markers.Close()
+	if err := markers.Mark("mail", "inbound/backfilled"); err != nil {
+		t.Fatalf("Mark() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{}
+	processMessage := newMessageProcessor(&emailPipeline{
+		live: newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+		s3Client: &fakeReplayS3{objects: map[string]fakeReplayObject{
+			"inbound/backfilled":  {body: testEmail},
+			"inbound/a":           {body: testEmail},
+			"inbound/quarantined": {body: testEmail},
+		}},
+		ledger:     newDeliveryLedger(time.Hour),
+		markers:    markers,
+		retryLease: time.Hour,
+	})
+	s3Action := func(key string) sqsTypes.Message {
+		return snsMessage(t, sesActionNotification(`{"type": "S3", "bucketName": "mail", "objectKey": "`+key+`"}`, `""`))
+	}
+
+	// An email the scanner delivered while the message waited isn't
+	// delivered again
+	if err := processMessage(context.Background(), s3Action("inbound/backfilled")); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if len(deliverer.calls) != 0 {
+		t.Errorf("delivered to %v, want no deliveries", deliverer.calls)
+	}
+
+	// A transient failure leases the email to the message until it is
+	// retried, and success marks it processed
+	deliverer.err = errors.New("connection refused")
+	if err := processMessage(context.Background(), s3Action("inbound/a")); err == nil {
+		t.Fatalf("processMessage() error = nil, want a transient error")
+	}
+	if !markers.Leased("mail", "inbound/a", time.Now()) || markers.Has("mail", "inbound/a") {
+		t.Errorf("email isn't leased after a transient failure")
+	}
+	deliverer.err = nil
+	if err := processMessage(context.Background(), s3Action("inbound/a")); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+	if !markers.Has("mail", "inbound/a") {
+		t.Errorf("email isn't marked processed after delivery")
+	}
+
+	// A message quarantined after a permanent failure is still delivered
+	// when it comes back, once the cause is fixed
+	deliverer.err = &smtp.SMTPError{Code: 550, Message: "no such user"}
+	if err := processMessage(context.Background(), s3Action("inbound/quarantined")); err == nil || isRetryable(err) {
+		t.Fatalf("processMessage() error = %v, want a permanent error", err)
+	}
+	if !markers.Failed("mail", "inbound/quarantined") || markers.Has("mail", "inbound/quarantined") {
+		t.Errorf("email isn't marked failed after a permanent failure")
+	}
+	deliverer.err = nil
+	if err := processMessage(context.Background(), s3Action("inbound/quarantined")); err != nil {
+		t.Fatalf("processMessage() error = %v when the message came back", err)
+	}
+	if !markers.Has("mail", "inbound/quarantined") {
+		t.Errorf("email isn't marked processed after delivery")
+	}
+	expected := [][]string{{"user@example.com"}, {"user@example.com"}, {"user@example.com"}, {"user@example.com"}}
+	if !reflect.DeepEqual(deliverer.calls, expected) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expected)
+	}
+}
+
+func TestBackfillerScanSinceMarkerFile(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "processed")
+	if err := os.WriteFile(path, []byte("since "+now.Add(-3*time.Hour).Format(time.RFC3339)+"\n"), 0o644); err != nil {
+		t.Fatalf("failed to write marker file: %v", err)
+	}
+	markers, err := openMarkerFile(path)
+	if err != nil {
+		t.Fatalf("openMarkerFile() error = %v", err)
+	}
+	defer markers.Close()
+
+	email := "From: sender@example.net\r\nTo: a@example.com\r\n\r\nbody\r\n"
+	client := &fakeReplayS3{pageSize: 10, objects: map[string]fakeReplayObject{
+		"inbound/before": {body: email, modified: now.Add(-5 * time.Hour)},
+		"inbound/after":  {body: email, modified: now.Add(-time.Hour)},
+	}}
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"a@example.com"},
+		DefaultMailbox: "a@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	b := &backfiller{
+		pipeline: &emailPipeline{
+			live:     newLiveConfig("", envMap(nil), defaultConfig(), resolver, &recordingDeliverer{}),
+			s3Client: client,
+			ledger:   newDeliveryLedger(time.Hour),
+			markers:  markers,
+		},
+		client: client,
+		cfg:    BackfillConfig{Bucket: "mail", Prefix: "inbound/", MinAge: 15 * time.Minute},
+		now:    func() time.Time { return now },
+	}
+
+	// Without BACKFILL_SINCE, emails stored before the marker file was
+	// started aren't delivered again
+	result, err := b.scan(context.Background())
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	expected := backfillResult{found: 1, delivered: 1}
+	if result != expected {
+		t.Errorf("scan() = %+v, want %+v", result, expected)
+	}
+	if !markers.Has("mail", "inbound/after") || markers.Has("mail", "inbound/before") {
+		t.Errorf("scan() delivered the wrong emails")
+	}
+}
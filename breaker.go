@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Circuit breaker states
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops traffic to a backend after threshold consecutive
+// failures. Once cooldown has passed a single trial request is let through;
+// its outcome closes the breaker again or restarts the cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+	lastErr  error
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether a request may be sent. In the half-open state only
+// the first caller is allowed through until Success or Failure is called.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Success records a successful request and closes the breaker.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	b.lastErr = nil
+}
+
+// Failure records a failed request, opening the breaker once the threshold is
+// reached.
+func (b *circuitBreaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	b.lastErr = err
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the breaker state, the number of consecutive failures and the
+// last error.
+func (b *circuitBreaker) State() (string, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state(), b.failures, b.lastErr
+}
+
+// state returns the breaker state. The caller must hold b.mu.
+func (b *circuitBreaker) state() string {
+	switch {
+	case b.failures < b.threshold:
+		return breakerClosed
+	case time.Since(b.openedAt) >= b.cooldown:
+		return breakerHalfOpen
+	default:
+		return breakerOpen
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(2, 20*time.Millisecond)
+	errDown := errors.New("connection refused")
+
+	if !breaker.Allow() {
+		t.Fatalf("Allow() = false on a new breaker")
+	}
+
+	breaker.Failure(errDown)
+	if state, failures, _ := breaker.State(); state != breakerClosed || failures != 1 {
+		t.Errorf("State() = %v, %v, want %v, 1", state, failures, breakerClosed)
+	}
+	if !breaker.Allow() {
+		t.Errorf("Allow() = false below the threshold")
+	}
+
+	breaker.Failure(errDown)
+	if state, _, lastErr := breaker.State(); state != breakerOpen || lastErr != errDown {
+		t.Errorf("State() = %v, %v, want %v, %v", state, lastErr, breakerOpen, errDown)
+	}
+	if breaker.Allow() {
+		t.Errorf("Allow() = true on an open breaker")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if state, _, _ := breaker.State(); state != breakerHalfOpen {
+		t.Errorf("State() = %v, want %v", state, breakerHalfOpen)
+	}
+	if !breaker.Allow() {
+		t.Errorf("Allow() = false for the half-open trial")
+	}
+	if breaker.Allow() {
+		t.Errorf("Allow() = true for a second half-open request")
+	}
+
+	// A failed trial restarts the cooldown.
+	breaker.Failure(errDown)
+	if state, _, _ := breaker.State(); state != breakerOpen {
+		t.Errorf("State() after failed trial = %v, want %v", state, breakerOpen)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Errorf("Allow() = false for the half-open trial")
+	}
+	breaker.Success()
+	if state, failures, lastErr := breaker.State(); state != breakerClosed || failures != 0 || lastErr != nil {
+		t.Errorf("State() after successful trial = %v, %v, %v, want %v, 0, nil", state, failures, lastErr, breakerClosed)
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	breaker := newCircuitBreaker(2, time.Minute)
+	breaker.Failure(errors.New("timeout"))
+	breaker.Success()
+	breaker.Failure(errors.New("timeout"))
+
+	if state, failures, _ := breaker.State(); state != breakerClosed || failures != 1 {
+		t.Errorf("State() = %v, %v, want %v, 1", state, failures, breakerClosed)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const (
+	// Catch-all actions that don't deliver to a mailbox
+	catchAllDrop   = "drop"
+	catchAllReject = "reject"
+)
+
+// errRejected is returned for recipients rejected by a catch-all.
+var errRejected = errors.New("recipient rejected by catch-all")
+
+// catchAll is what happens to mail for unknown recipients at a domain: it is
+// delivered to targets, or dropped or rejected if action is set.
+type catchAll struct {
+	targets []string
+	action  string
+}
+
+// newCatchAll checks the catch-all rules given as a map of domain to targets,
+// as in the config file, where targets is a list of mailboxes or one of the
+// actions drop and reject. The returned map is keyed by the lowercased domain.
+func newCatchAll(table map[string]stringList) (map[string]catchAll, error) {
+	rules := make(map[string]catchAll, len(table))
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(key), "@"))
+		if domain == "" || strings.Contains(domain, "@") {
+			return nil, fmt.Errorf("invalid catch-all %q: expected a domain", key)
+		}
+		if _, ok := rules[domain]; ok {
+			return nil, fmt.Errorf("invalid catch-all %q: domain %q is listed more than once", key, domain)
+		}
+
+		targets := Filter(Map(table[key], strings.TrimSpace), func(t string) bool {
+			return t != ""
+		})
+		if len(targets) == 1 {
+			switch action := strings.ToLower(targets[0]); action {
+			case catchAllDrop, catchAllReject:
+				rules[domain] = catchAll{action: action}
+				continue
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("invalid catch-all %q: no targets", key)
+		}
+		for _, t := range targets {
+			if !strings.Contains(t, "@") {
+				return nil, fmt.Errorf("invalid catch-all %q: target %q is not an email address or one of %q and %q", key, t, catchAllDrop, catchAllReject)
+			}
+		}
+		rules[domain] = catchAll{targets: targets}
+	}
+	return rules, nil
+}
+
+// rejectedError returns the error reported for recipients rejected by a
+// catch-all, or nil if there are none. It is permanent, so the failure policy
+// is applied; once the other recipients have the message it is wrapped with
+// delivered so that it isn't quarantined.
+func rejectedError(rejected recipientErrors) error {
+	if len(rejected) == 0 {
+		return nil
+	}
+	return fmt.Errorf("rejected %d recipients: %w", len(rejected), rejected)
+}
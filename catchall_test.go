@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewCatchAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string]catchAll
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[string]catchAll{},
+		},
+		{
+			name:  "targets and actions",
+			input: "Domain2.tld=postmaster@domain2.tld; @domain3.tld=owner@domain3.tld, backup@domain3.tld;spam.tld=drop;junk.tld=REJECT",
+			expected: map[string]catchAll{
+				"domain2.tld": {targets: []string{"postmaster@domain2.tld"}},
+				"domain3.tld": {targets: []string{"owner@domain3.tld", "backup@domain3.tld"}},
+				"spam.tld":    {action: catchAllDrop},
+				"junk.tld":    {action: catchAllReject},
+			},
+		},
+		{
+			name:      "missing targets",
+			input:     "domain2.tld=",
+			expectErr: true,
+		},
+		{
+			name:      "target is not an address",
+			input:     "domain2.tld=discard",
+			expectErr: true,
+		},
+		{
+			name:      "address instead of domain",
+			input:     "user@domain2.tld=postmaster@domain2.tld",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate domain",
+			input:     "domain2.tld=drop;DOMAIN2.tld=reject",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given as in CATCH_ALL
+			var result map[string]catchAll
+			table, err := parseListMap(tt.input)
+			if err == nil {
+				result, err = newCatchAll(table)
+			}
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("newCatchAll() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("newCatchAll() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRejectedError(t *testing.T) {
+	if err := rejectedError(nil); err != nil {
+		t.Errorf("rejectedError(nil) = %v, want nil", err)
+	}
+
+	err := rejectedError(recipientErrors{"a@junk.tld": permanent(errRejected)})
+	if !errors.Is(err, errRejected) {
+		t.Errorf("rejectedError() = %v, want %v", err, errRejected)
+	}
+	if isRetryable(err) {
+		t.Errorf("isRetryable(%v) = true, want false", err)
+	}
+}
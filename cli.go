@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+const usage = `Usage: ses2lmtp [command] [flags]
+
+Commands:
+  run           Poll the configured queues and deliver their messages (default)
+  check-config  Validate the configuration without connecting to anything
+  doctor        Check access to SQS, S3 and the mail servers
+  replay        Redeliver emails stored in S3
+  backfill      Deliver the emails in the SES bucket that were never processed
+
+Run "ses2lmtp <command> -h" for the flags of a command.
+`
+
+// run runs the subcommand named by the first argument and returns the exit
+// status. Without a subcommand the service is started.
+func run(args []string, stdout, stderr io.Writer) int {
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "run":
+		return serve(args, stderr)
+	case "check-config":
+		return checkConfigCommand(args, stdout, stderr)
+	case "doctor":
+		return doctorCommand(args, stdout, stderr)
+	case "replay":
+		return replayCommand(args, stdout, stderr)
+	case "backfill":
+		return backfillCommand(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+}
+
+// newFlagSet returns a flag set for command that reports errors to stderr
+// instead of exiting.
+func newFlagSet(command string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("ses2lmtp "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	return flags
+}
+
+// configFlag adds the -config flag shared by every command.
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML config file (default $CONFIG_FILE)")
+}
+
+// printConfigError reports every configuration problem in err.
+func printConfigError(w io.Writer, err error) {
+	fmt.Fprintf(w, "invalid configuration:\n%s\n", formatConfigError(err))
+}
+
+// checkConfigCommand validates the configuration from the config file and the
+// environment, including the alias file and TLS certificates, without
+// connecting to AWS or the mail servers.
+func checkConfigCommand(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("check-config", stderr)
+	configPath := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+
+	fmt.Fprintln(stdout, "configuration is valid")
+	summary := cfg.Summary()
+	for _, key := range slices.Sorted(maps.Keys(summary)) {
+		fmt.Fprintf(stdout, "  %s: %s\n", key, summary[key])
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	validConfig := writeConfigFile(t, `
+queues:
+  - url: https://sqs.us-east-1.amazonaws.com/123456789012/inbound
+sns:
+  topicArns: [arn:aws:sns:us-east-1:123456789012:ses-inbound]
+recipients:
+  mailboxes: [user@example.com]
+  defaultMailbox: user@example.com
+delivery:
+  lmtp:
+    hosts: [mail:24]
+    from: ses@example.com
+`)
+	invalidConfig := writeConfigFile(t, "workerCount: 0\n")
+
+	tests := []struct {
+		name           string
+		args           []string
+		expected       int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{
+			name:           "help",
+			args:           []string{"help"},
+			expected:       0,
+			expectedStdout: "check-config",
+		},
+		{
+			name:           "unknown command",
+			args:           []string{"frobnicate"},
+			expected:       2,
+			expectedStderr: `unknown command "frobnicate"`,
+		},
+		{
+			name:           "unknown flag",
+			args:           []string{"check-config", "-frobnicate"},
+			expected:       2,
+			expectedStderr: "flag provided but not defined",
+		},
+		{
+			name:           "valid config",
+			args:           []string{"check-config", "-config", validConfig},
+			expected:       0,
+			expectedStdout: "configuration is valid",
+		},
+		{
+			name:           "invalid config",
+			args:           []string{"check-config", "-config", invalidConfig},
+			expected:       1,
+			expectedStderr: "  - workerCount (WORKER_COUNT): must be at least 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if result := run(tt.args, &stdout, &stderr); result != tt.expected {
+				t.Errorf("run() = %v, want %v (stderr: %s)", result, tt.expected, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.expectedStdout) {
+				t.Errorf("run() stdout = %q, want it to contain %q", stdout.String(), tt.expectedStdout)
+			}
+			if !strings.Contains(stderr.String(), tt.expectedStderr) {
+				t.Errorf("run() stderr = %q, want it to contain %q", stderr.String(), tt.expectedStderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	smtp "github.com/emersion/go-smtp"
+)
+
+const (
+	// TLS modes. The opportunistic and required modes upgrade the connection
+	// with STARTTLS, implicit starts TLS as soon as the connection is made.
+	tlsModeNone          = "none"
+	tlsModeOpportunistic = "opportunistic"
+	tlsModeRequired      = "required"
+	tlsModeImplicit      = "implicit"
+
+	// SASL mechanisms
+	authMechanismPlain = "PLAIN"
+	authMechanismLogin = "LOGIN"
+)
+
+// recipientErrors maps the recipients a message couldn't be delivered to onto
+// the reason why. Recipients that aren't in the map accepted the message.
+type recipientErrors map[string]error
+
+func (e recipientErrors) Error() string {
+	recipients := make([]string, 0, len(e))
+	for r := range e {
+		recipients = append(recipients, r)
+	}
+	sort.Strings(recipients)
+
+	msgs := make([]string, len(recipients))
+	for i, r := range recipients {
+		msgs[i] = fmt.Sprintf("<%s>: %v", r, e[r])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e recipientErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// clientOptions configures how an SMTP or LMTP session is set up.
+type clientOptions struct {
+	// lmtp selects LMTP (LHLO and per-recipient DATA replies) over SMTP.
+	lmtp bool
+	// heloName is the name sent with EHLO or LHLO.
+	heloName string
+	// tlsMode is one of the TLS modes.
+	tlsMode   string
+	tlsConfig *tls.Config
+	// auth returns a new SASL client for each connection, or is nil to skip
+	// authentication.
+	auth func() sasl.Client
+}
+
+// dialClient connects to address and returns a client that has greeted the
+// server and, depending on opts, negotiated TLS and authenticated.
+func dialClient(ctx context.Context, network, address string, opts clientOptions) (*smtp.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %w", address, err)
+	}
+
+	// Abort the handshake if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	heloName := opts.heloName
+	if heloName == "" {
+		heloName = "localhost"
+	}
+
+	switch opts.tlsMode {
+	case tlsModeOpportunistic, tlsModeRequired:
+		tlsConn, err := startTLS(conn, opts.lmtp, heloName, opts.tlsMode, opts.tlsConfig)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to start tls with %s: %w", address, err)
+		}
+		conn = tlsConn
+	case tlsModeImplicit:
+		tlsConn := tls.Client(conn, opts.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to start tls with %s: %w", address, err)
+		}
+		conn = tlsConn
+	}
+
+	var c *smtp.Client
+	if opts.lmtp {
+		c = smtp.NewClientLMTP(conn)
+	} else {
+		c = smtp.NewClient(conn)
+	}
+	if err := c.Hello(heloName); err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("failed to greet %s: %w", address, err)
+	}
+
+	if opts.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			_ = c.Close()
+			return nil, fmt.Errorf("%s doesn't support AUTH", address)
+		}
+		// Authentication failures are a configuration problem rather than
+		// something wrong with the message, so the server's reply isn't
+		// wrapped and the failure is retried like any other transient error.
+		if err := c.Auth(opts.auth()); err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("failed to authenticate with %s: %v", address, err)
+		}
+	}
+
+	return c, nil
+}
+
+// startTLS upgrades a freshly dialed connection with STARTTLS.
+//
+// go-smtp can only start TLS on SMTP clients and only before the EHLO name is
+// chosen, so the exchange is done here and the resulting connection replays
+// the server greeting for the client created on top of it. In opportunistic
+// mode a server that doesn't offer STARTTLS is used in plaintext.
+func startTLS(conn net.Conn, lmtp bool, heloName, mode string, tlsConfig *tls.Config) (net.Conn, error) {
+	text := textproto.NewConn(conn)
+
+	_, greeting, err := text.ReadResponse(220)
+	if err != nil {
+		return nil, err
+	}
+	greeting = fmt.Sprintf("220 %s\r\n", strings.SplitN(greeting, "\n", 2)[0])
+
+	hello := "EHLO"
+	if lmtp {
+		hello = "LHLO"
+	}
+	_, extensions, err := textCmd(text, 250, "%s %s", hello, heloName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasExtension(extensions, "STARTTLS") {
+		if mode == tlsModeRequired {
+			return nil, errors.New("server doesn't support STARTTLS")
+		}
+		return &greetedConn{Conn: conn, r: io.MultiReader(strings.NewReader(greeting), text.R)}, nil
+	}
+
+	if _, _, err := textCmd(text, 220, "STARTTLS"); err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return &greetedConn{Conn: tlsConn, r: io.MultiReader(strings.NewReader(greeting), tlsConn)}, nil
+}
+
+// textCmd sends a command and reads its response.
+func textCmd(text *textproto.Conn, expectCode int, format string, args ...any) (int, string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	return text.ReadResponse(expectCode)
+}
+
+// hasExtension reports whether an EHLO or LHLO response advertises ext.
+func hasExtension(response, ext string) bool {
+	lines := strings.Split(response, "\n")
+	for _, line := range lines[1:] {
+		if strings.EqualFold(strings.Fields(line + " ")[0], ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// greetedConn is a connection whose server greeting has already been read. The
+// greeting is replayed to the next reader.
+type greetedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *greetedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// newSASLClient returns a constructor for SASL clients using mechanism.
+func newSASLClient(mechanism, username, password string) (func() sasl.Client, error) {
+	switch strings.ToUpper(mechanism) {
+	case authMechanismPlain:
+		return func() sasl.Client { return sasl.NewPlainClient("", username, password) }, nil
+	case authMechanismLogin:
+		return func() sasl.Client { return sasl.NewLoginClient(username, password) }, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mechanism %q, expected %q or %q", mechanism, authMechanismPlain, authMechanismLogin)
+	}
+}
+
+// validateTLSMode checks that mode is one of the TLS modes.
+func validateTLSMode(mode string) error {
+	switch mode {
+	case tlsModeNone, tlsModeOpportunistic, tlsModeRequired, tlsModeImplicit:
+		return nil
+	default:
+		return fmt.Errorf("unknown tls mode %q, expected one of %q, %q, %q or %q", mode, tlsModeNone, tlsModeOpportunistic, tlsModeRequired, tlsModeImplicit)
+	}
+}
+
+// newTLSConfig returns a client TLS configuration that verifies the server as
+// serverName. If caFile is set the server certificate must be signed by one of
+// the PEM certificates in it rather than by a system root. If certFile and
+// keyFile are set the client presents that certificate to the server.
+func newTLSConfig(serverName, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %q", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// sendMail runs a single mail transaction. If any recipient didn't accept the
+// message a recipientErrors is returned; any other error means the message
+// wasn't delivered to anyone.
+//
+// LMTP servers reply once per recipient after DATA, so some recipients may
+// accept the message while others reject it. SMTP servers only reject
+// recipients individually at RCPT.
+func sendMail(c *smtp.Client, lmtp bool, from string, to []string, body io.Reader) error {
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+
+	failed := recipientErrors{}
+	accepted := make([]string, 0, len(to))
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				return err
+			}
+			failed[rcpt] = err
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return failed
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return err
+	}
+
+	if !lmtp {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if len(failed) > 0 {
+			return failed
+		}
+		return nil
+	}
+
+	// Recipients without a response were cut off by a connection error and
+	// are reported with that error.
+	resp, err := w.CloseWithLMTPResponse()
+	var lmtpErr smtp.LMTPDataError
+	errors.As(err, &lmtpErr)
+	for _, rcpt := range accepted {
+		if _, ok := resp[rcpt]; ok {
+			continue
+		}
+		if rcptErr, ok := lmtpErr[rcpt]; ok {
+			failed[rcpt] = rcptErr
+		} else {
+			failed[rcpt] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the application configuration. It is read from the YAML file
+// named by CONFIG_FILE, if any, and then overridden by environment variables.
+// See README.md for the schema.
+type Config struct {
+	Queues            []QueueConfig    `yaml:"queues"`
+	HealthCheckPort   string           `yaml:"healthCheckPort"`
+	WorkerCount       int              `yaml:"workerCount"`
+	ShutdownTimeout   time.Duration    `yaml:"shutdownTimeout"`
+	VisibilityTimeout time.Duration    `yaml:"visibilityTimeout"`
+	WatchInterval     time.Duration    `yaml:"watchInterval"`
+	DryRun            DryRunConfig     `yaml:"dryRun"`
+	Backfill          BackfillConfig   `yaml:"backfill"`
+	SNS               SNSConfig        `yaml:"sns"`
+	Retry             RetryConfig      `yaml:"retry"`
+	Recipients        RecipientsConfig `yaml:"recipients"`
+	Delivery          DeliveryConfig   `yaml:"delivery"`
+}
+
+// QueueConfig is an SQS queue to receive SES notifications from.
+type QueueConfig struct {
+	URL string `yaml:"url"`
+}
+
+// DryRunConfig controls dry runs, in which messages are processed and their
+// delivery logged, but nothing is delivered or deleted from the queue.
+type DryRunConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	ResetVisibility bool `yaml:"resetVisibility"`
+}
+
+// SNSConfig controls how far SNS notifications are trusted.
+type SNSConfig struct {
+	// SignatureVerification is off, verify to check the signature of every
+	// SNS notification, or require to also reject messages that don't come
+	// in one.
+	SignatureVerification string `yaml:"signatureVerification"`
+	// TopicArns are the SNS topics notifications are accepted from. A
+	// notification from any other topic is rejected, even if SNS signed it.
+	TopicArns []string `yaml:"topicArns"`
+}
+
+// BackfillConfig controls the scanner that delivers emails SES stored in its
+// bucket but that never arrived through SQS.
+type BackfillConfig struct {
+	// Bucket and Prefix are where the SES receipt rule stores emails.
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	// MarkerFile records the keys of the emails that have been processed,
+	// whether from SQS or by the scanner.
+	MarkerFile string `yaml:"markerFile"`
+	// Since excludes emails stored before it, which were dealt with before
+	// the marker file existed. It defaults to when the marker file was
+	// created.
+	Since time.Time `yaml:"since"`
+	// MinAge excludes emails stored so recently that SQS may still deliver
+	// them.
+	MinAge time.Duration `yaml:"minAge"`
+	// Interval is how often the service scans the bucket. The scanner only
+	// runs through the backfill command when it is zero.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RetryConfig controls how failed messages are retried.
+type RetryConfig struct {
+	BaseDelay              time.Duration `yaml:"baseDelay"`
+	MaxDelay               time.Duration `yaml:"maxDelay"`
+	PermanentFailurePolicy string        `yaml:"permanentFailurePolicy"`
+	DeadLetterQueueURL     string        `yaml:"deadLetterQueueUrl"`
+}
+
+// RecipientsConfig controls which mailboxes a message is delivered to.
+type RecipientsConfig struct {
+	Mailboxes              []string              `yaml:"mailboxes"`
+	DefaultMailbox         string                `yaml:"defaultMailbox"`
+	CaseSensitiveLocalPart bool                  `yaml:"caseSensitiveLocalPart"`
+	AliasFile              string                `yaml:"aliasFile"`
+	Aliases                map[string]stringList `yaml:"aliases"`
+	CatchAll               map[string]stringList `yaml:"catchAll"`
+	Subaddress             SubaddressConfig      `yaml:"subaddress"`
+}
+
+// SubaddressConfig controls how subaddresses are matched and delivered.
+type SubaddressConfig struct {
+	Delimiter string            `yaml:"delimiter"`
+	Mode      string            `yaml:"mode"`
+	Folders   map[string]string `yaml:"folders"`
+}
+
+// DeliveryConfig selects and configures the delivery backend.
+type DeliveryConfig struct {
+	Protocol string     `yaml:"protocol"`
+	LMTP     LMTPConfig `yaml:"lmtp"`
+	SMTP     SMTPConfig `yaml:"smtp"`
+}
+
+// LMTPConfig configures delivery to LMTP servers.
+type LMTPConfig struct {
+	Hosts            []string              `yaml:"hosts"`
+	From             string                `yaml:"from"`
+	Routes           map[string]stringList `yaml:"routes"`
+	Balance          string                `yaml:"balance"`
+	PoolSize         int                   `yaml:"poolSize"`
+	PoolIdleTimeout  time.Duration         `yaml:"poolIdleTimeout"`
+	ProbeInterval    time.Duration         `yaml:"probeInterval"`
+	FailureThreshold int                   `yaml:"failureThreshold"`
+	BreakerCooldown  time.Duration         `yaml:"breakerCooldown"`
+	TLS              TLSConfig             `yaml:"tls"`
+	Auth             AuthConfig            `yaml:"auth"`
+}
+
+// SMTPConfig configures delivery to an SMTP relay.
+type SMTPConfig struct {
+	Host     string     `yaml:"host"`
+	From     string     `yaml:"from"`
+	HeloName string     `yaml:"heloName"`
+	StartTLS string     `yaml:"startTLS"`
+	Auth     AuthConfig `yaml:"auth"`
+}
+
+// TLSConfig configures TLS for LMTP connections.
+type TLSConfig struct {
+	Mode       string `yaml:"mode"`
+	ServerName string `yaml:"serverName"`
+	CAFile     string `yaml:"caFile"`
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+}
+
+// AuthConfig holds SASL AUTH credentials. Authentication is skipped when
+// Username is empty.
+type AuthConfig struct {
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Mechanism string `yaml:"mechanism"`
+}
+
+// stringList is a list of strings that may be given in YAML as a single
+// string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// defaultConfig returns the configuration used for everything that isn't set
+// in the config file or the environment.
+func defaultConfig() *Config {
+	return &Config{
+		HealthCheckPort:   "8080",
+		WorkerCount:       4,
+		ShutdownTimeout:   30 * time.Second,
+		VisibilityTimeout: time.Minute,
+		Backfill: BackfillConfig{
+			MinAge: 15 * time.Minute,
+		},
+		SNS: SNSConfig{
+			SignatureVerification: snsVerificationRequire,
+		},
+		Retry: RetryConfig{
+			BaseDelay:              30 * time.Second,
+			MaxDelay:               time.Hour,
+			PermanentFailurePolicy: failurePolicyQuarantine,
+		},
+		Recipients: RecipientsConfig{
+			Subaddress: SubaddressConfig{Mode: subaddressKeep},
+		},
+		Delivery: DeliveryConfig{
+			Protocol: deliveryProtocolLMTP,
+			LMTP: LMTPConfig{
+				Balance:          balancePriority,
+				PoolSize:         4,
+				PoolIdleTimeout:  30 * time.Second,
+				ProbeInterval:    30 * time.Second,
+				FailureThreshold: 3,
+				BreakerCooldown:  30 * time.Second,
+				TLS:              TLSConfig{Mode: tlsModeNone},
+				Auth:             AuthConfig{Mechanism: authMechanismPlain},
+			},
+			SMTP: SMTPConfig{
+				HeloName: defaultHeloName(),
+				StartTLS: tlsModeOpportunistic,
+				Auth:     AuthConfig{Mechanism: authMechanismPlain},
+			},
+		},
+	}
+}
+
+// loadConfig reads the config file at path, if path isn't empty, applies the
+// environment variable overrides found with lookupEnv and validates the
+// result. All problems are reported together.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config file %q: %w", path, err)
+		}
+	}
+
+	if err := c.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides the configuration with the environment variables that are
+// set. Empty variables are treated as unset.
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	env := &envOverrides{lookupEnv: lookupEnv}
+
+	env.Func("SQS_QUEUE_URL", func(v string) error {
+		c.Queues = nil
+		for _, url := range splitList(v) {
+			c.Queues = append(c.Queues, QueueConfig{URL: url})
+		}
+		return nil
+	})
+	env.String("HEALTH_CHECK_PORT", &c.HealthCheckPort)
+	env.Int("WORKER_COUNT", &c.WorkerCount)
+	env.Duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	env.Duration("VISIBILITY_TIMEOUT", &c.VisibilityTimeout)
+	env.Duration("CONFIG_WATCH_INTERVAL", &c.WatchInterval)
+	env.Bool("DRY_RUN", &c.DryRun.Enabled)
+	env.Bool("DRY_RUN_RESET_VISIBILITY", &c.DryRun.ResetVisibility)
+
+	env.String("BACKFILL_BUCKET", &c.Backfill.Bucket)
+	env.String("BACKFILL_PREFIX", &c.Backfill.Prefix)
+	env.String("BACKFILL_MARKER_FILE", &c.Backfill.MarkerFile)
+	env.Func("BACKFILL_SINCE", func(v string) (err error) {
+		c.Backfill.Since, err = parseTime(v)
+		return err
+	})
+	env.Duration("BACKFILL_MIN_AGE", &c.Backfill.MinAge)
+	env.Duration("BACKFILL_INTERVAL", &c.Backfill.Interval)
+
+	env.String("SNS_SIGNATURE_VERIFICATION", &c.SNS.SignatureVerification)
+	env.Func("SNS_TOPIC_ARNS", func(v string) error {
+		c.SNS.TopicArns = splitList(v)
+		return nil
+	})
+
+	env.Duration("RETRY_BASE_DELAY", &c.Retry.BaseDelay)
+	env.Duration("RETRY_MAX_DELAY", &c.Retry.MaxDelay)
+	env.String("PERMANENT_FAILURE_POLICY", &c.Retry.PermanentFailurePolicy)
+	env.String("DEAD_LETTER_QUEUE_URL", &c.Retry.DeadLetterQueueURL)
+
+	r := &c.Recipients
+	env.Func("MAILBOXES", func(v string) error {
+		r.Mailboxes = Filter(splitMailboxPatterns(v), func(p string) bool {
+			return p != ""
+		})
+		return nil
+	})
+	env.String("DEFAULT_MAILBOX", &r.DefaultMailbox)
+	env.Bool("MAILBOX_CASE_SENSITIVE_LOCAL_PART", &r.CaseSensitiveLocalPart)
+	env.String("ALIAS_FILE", &r.AliasFile)
+	env.Func("CATCH_ALL", func(v string) error {
+		rules, err := parseListMap(v)
+		r.CatchAll = rules
+		return err
+	})
+	env.String("RECIPIENT_DELIMITER", &r.Subaddress.Delimiter)
+	env.String("SUBADDRESS_MODE", &r.Subaddress.Mode)
+	env.Func("SUBADDRESS_FOLDERS", func(v string) error {
+		folders, err := parseSubaddressFolders(v)
+		r.Subaddress.Folders = folders
+		return err
+	})
+
+	d := &c.Delivery
+	env.String("DELIVERY_PROTOCOL", &d.Protocol)
+
+	env.Func("LMTP_HOST", func(v string) error {
+		d.LMTP.Hosts = splitList(v)
+		return nil
+	})
+	env.String("LMTP_FROM", &d.LMTP.From)
+	env.Func("LMTP_ROUTES", func(v string) error {
+		routes, err := parseListMap(v)
+		d.LMTP.Routes = routes
+		return err
+	})
+	env.String("LMTP_BALANCE", &d.LMTP.Balance)
+	env.Int("LMTP_POOL_SIZE", &d.LMTP.PoolSize)
+	env.Duration("LMTP_POOL_IDLE_TIMEOUT", &d.LMTP.PoolIdleTimeout)
+	env.Duration("LMTP_PROBE_INTERVAL", &d.LMTP.ProbeInterval)
+	env.Int("LMTP_FAILURE_THRESHOLD", &d.LMTP.FailureThreshold)
+	env.Duration("LMTP_BREAKER_COOLDOWN", &d.LMTP.BreakerCooldown)
+	env.String("LMTP_TLS", &d.LMTP.TLS.Mode)
+	env.String("LMTP_TLS_SERVER_NAME", &d.LMTP.TLS.ServerName)
+	env.String("LMTP_TLS_CA_FILE", &d.LMTP.TLS.CAFile)
+	env.String("LMTP_TLS_CERT_FILE", &d.LMTP.TLS.CertFile)
+	env.String("LMTP_TLS_KEY_FILE", &d.LMTP.TLS.KeyFile)
+	env.String("LMTP_USERNAME", &d.LMTP.Auth.Username)
+	env.String("LMTP_PASSWORD", &d.LMTP.Auth.Password)
+	env.String("LMTP_AUTH_MECHANISM", &d.LMTP.Auth.Mechanism)
+
+	env.String("SMTP_HOST", &d.SMTP.Host)
+	env.String("SMTP_FROM", &d.SMTP.From)
+	env.String("SMTP_HELO_NAME", &d.SMTP.HeloName)
+	env.String("SMTP_STARTTLS", &d.SMTP.StartTLS)
+	env.String("SMTP_USERNAME", &d.SMTP.Auth.Username)
+	env.String("SMTP_PASSWORD", &d.SMTP.Auth.Password)
+	env.String("SMTP_AUTH_MECHANISM", &d.SMTP.Auth.Mechanism)
+
+	return errors.Join(env.errs...)
+}
+
+// Validate checks the configuration, returning every problem it finds joined
+// into one error.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Queues) == 0 && c.Backfill.Interval == 0 {
+		invalid("queues: at least one queue is required (SQS_QUEUE_URL) unless the bucket is scanned instead (BACKFILL_INTERVAL)")
+	}
+	seen := make(map[string]bool)
+	for i, q := range c.Queues {
+		switch {
+		case q.URL == "":
+			invalid("queues[%d].url: is required", i)
+		case seen[q.URL]:
+			invalid("queues[%d].url: queue %q is listed more than once", i, q.URL)
+		}
+		seen[q.URL] = true
+	}
+	if c.HealthCheckPort == "" {
+		invalid("healthCheckPort (HEALTH_CHECK_PORT): is required")
+	}
+	if c.WorkerCount < 1 {
+		invalid("workerCount (WORKER_COUNT): must be at least 1")
+	}
+	if c.ShutdownTimeout < 0 {
+		invalid("shutdownTimeout (SHUTDOWN_TIMEOUT): must not be negative")
+	}
+	if c.VisibilityTimeout < 3*time.Second || c.VisibilityTimeout > 12*time.Hour {
+		invalid("visibilityTimeout (VISIBILITY_TIMEOUT): must be between 3s and 12h")
+	}
+	if c.WatchInterval < 0 {
+		invalid("watchInterval (CONFIG_WATCH_INTERVAL): must not be negative")
+	}
+
+	b := c.Backfill
+	if b.Bucket == "" && (b.Interval > 0 || b.MarkerFile != "") {
+		invalid("backfill.bucket (BACKFILL_BUCKET): is required to scan for or mark processed emails")
+	}
+	if b.Bucket != "" && b.MarkerFile == "" {
+		invalid("backfill.markerFile (BACKFILL_MARKER_FILE): is required with a bucket")
+	}
+	if b.MinAge < 0 {
+		invalid("backfill.minAge (BACKFILL_MIN_AGE): must not be negative")
+	}
+	if b.Interval < 0 {
+		invalid("backfill.interval (BACKFILL_INTERVAL): must not be negative")
+	}
+
+	if err := validateSNSVerification(c.SNS.SignatureVerification); err != nil {
+		invalid("sns.signatureVerification (SNS_SIGNATURE_VERIFICATION): %v", err)
+	}
+	if c.SNS.SignatureVerification != snsVerificationOff && len(c.SNS.TopicArns) == 0 {
+		invalid("sns.topicArns (SNS_TOPIC_ARNS): required unless sns.signatureVerification is %s", snsVerificationOff)
+	}
+	for _, arn := range c.SNS.TopicArns {
+		if _, err := snsCertificateHost(arn); err != nil {
+			invalid("sns.topicArns (SNS_TOPIC_ARNS): %v", err)
+		}
+	}
+
+	if c.Retry.BaseDelay <= 0 || c.Retry.MaxDelay < c.Retry.BaseDelay || c.Retry.MaxDelay > 12*time.Hour {
+		invalid("retry.baseDelay and retry.maxDelay (RETRY_BASE_DELAY, RETRY_MAX_DELAY): must satisfy 0 < base <= max <= 12h")
+	}
+	if err := validateFailurePolicy(c.Retry.PermanentFailurePolicy, c.Retry.DeadLetterQueueURL); err != nil {
+		invalid("retry.permanentFailurePolicy (PERMANENT_FAILURE_POLICY): %v", err)
+	}
+
+	if len(c.Recipients.Mailboxes) == 0 {
+		invalid("recipients.mailboxes (MAILBOXES): at least one mailbox is required")
+	}
+	if c.Recipients.DefaultMailbox == "" {
+		invalid("recipients.defaultMailbox (DEFAULT_MAILBOX): is required")
+	}
+	if _, err := newRecipientResolver(c.Recipients); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, c.Delivery.validate()...)
+	return errors.Join(errs...)
+}
+
+// validate checks the settings of the selected delivery protocol.
+func (d *DeliveryConfig) validate() []error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch d.Protocol {
+	case deliveryProtocolLMTP:
+		l := d.LMTP
+		if len(l.Hosts) == 0 && len(l.Routes) == 0 {
+			invalid("delivery.lmtp.hosts (LMTP_HOST): is required unless routes are configured")
+		}
+		if len(l.Hosts) > 0 {
+			if _, err := parseEndpoints(strings.Join(l.Hosts, ",")); err != nil {
+				invalid("delivery.lmtp.hosts (LMTP_HOST): %v", err)
+			}
+		}
+		if _, err := newRoutes(l.Routes); err != nil {
+			invalid("delivery.lmtp.routes (LMTP_ROUTES): %v", err)
+		}
+		if l.From == "" {
+			invalid("delivery.lmtp.from (LMTP_FROM): is required")
+		}
+		if l.Balance != balancePriority && l.Balance != balanceRoundRobin {
+			invalid("delivery.lmtp.balance (LMTP_BALANCE): unknown strategy %q, expected %q or %q", l.Balance, balancePriority, balanceRoundRobin)
+		}
+		if l.PoolSize < 0 {
+			invalid("delivery.lmtp.poolSize (LMTP_POOL_SIZE): must not be negative")
+		}
+		if l.ProbeInterval < 0 {
+			invalid("delivery.lmtp.probeInterval (LMTP_PROBE_INTERVAL): must not be negative")
+		}
+		if l.FailureThreshold < 1 {
+			invalid("delivery.lmtp.failureThreshold (LMTP_FAILURE_THRESHOLD): must be at least 1")
+		}
+		if err := validateTLSMode(l.TLS.Mode); err != nil {
+			invalid("delivery.lmtp.tls.mode (LMTP_TLS): %v", err)
+		} else if l.TLS.Mode != tlsModeNone {
+			if _, err := newTLSConfig(l.TLS.ServerName, l.TLS.CAFile, l.TLS.CertFile, l.TLS.KeyFile); err != nil {
+				invalid("delivery.lmtp.tls (LMTP_TLS_*): %v", err)
+			}
+		}
+		if err := l.Auth.validate(); err != nil {
+			invalid("delivery.lmtp.auth (LMTP_USERNAME, LMTP_PASSWORD, LMTP_AUTH_MECHANISM): %v", err)
+		}
+	case deliveryProtocolSMTP:
+		s := d.SMTP
+		if _, _, err := net.SplitHostPort(s.Host); err != nil {
+			invalid("delivery.smtp.host (SMTP_HOST): %v", err)
+		}
+		if err := validateTLSMode(s.StartTLS); err != nil {
+			invalid("delivery.smtp.startTLS (SMTP_STARTTLS): %v", err)
+		}
+		if err := s.Auth.validate(); err != nil {
+			invalid("delivery.smtp.auth (SMTP_USERNAME, SMTP_PASSWORD, SMTP_AUTH_MECHANISM): %v", err)
+		}
+	default:
+		invalid("delivery.protocol (DELIVERY_PROTOCOL): unknown delivery protocol %q, expected %q or %q", d.Protocol, deliveryProtocolLMTP, deliveryProtocolSMTP)
+	}
+	return errs
+}
+
+// validate checks that credentials are complete and the mechanism is known.
+func (a AuthConfig) validate() error {
+	if a.Username == "" {
+		return nil
+	}
+	if a.Password == "" {
+		return fmt.Errorf("a password is required with a username")
+	}
+	_, err := newSASLClient(a.Mechanism, a.Username, a.Password)
+	return err
+}
+
+// Summary returns the settings worth logging at startup. Credentials are left
+// out.
+func (c *Config) Summary() map[string]string {
+	r, d := c.Recipients, c.Delivery
+	var queues []string
+	for _, q := range c.Queues {
+		queues = append(queues, q.URL)
+	}
+	return map[string]string{
+		"queues":                   strings.Join(queues, ","),
+		"healthCheckPort":          c.HealthCheckPort,
+		"workerCount":              strconv.Itoa(c.WorkerCount),
+		"shutdownTimeout":          c.ShutdownTimeout.String(),
+		"visibilityTimeout":        c.VisibilityTimeout.String(),
+		"watchInterval":            c.WatchInterval.String(),
+		"dryRun":                   strconv.FormatBool(c.DryRun.Enabled),
+		"dryRunResetVisibility":    strconv.FormatBool(c.DryRun.ResetVisibility),
+		"backfillBucket":           c.Backfill.Bucket,
+		"backfillPrefix":           c.Backfill.Prefix,
+		"backfillMarkerFile":       c.Backfill.MarkerFile,
+		"backfillInterval":         c.Backfill.Interval.String(),
+		"backfillMinAge":           c.Backfill.MinAge.String(),
+		"snsSignatureVerification": c.SNS.SignatureVerification,
+		"snsTopicArns":             strings.Join(c.SNS.TopicArns, ","),
+		"retryBaseDelay":           c.Retry.BaseDelay.String(),
+		"retryMaxDelay":            c.Retry.MaxDelay.String(),
+		"failurePolicy":            c.Retry.PermanentFailurePolicy,
+		"deadLetterQueueURL":       c.Retry.DeadLetterQueueURL,
+		"mailboxes":                strings.Join(r.Mailboxes, ","),
+		"defaultMailbox":           r.DefaultMailbox,
+		"caseSensitiveLocalPart":   strconv.FormatBool(r.CaseSensitiveLocalPart),
+		"aliasFile":                r.AliasFile,
+		"recipientDelimiter":       r.Subaddress.Delimiter,
+		"subaddressMode":           r.Subaddress.Mode,
+		"catchAllDomains":          strconv.Itoa(len(r.CatchAll)),
+		"deliveryProtocol":         d.Protocol,
+	}
+}
+
+// formatConfigError lists the problems joined in err, one per line.
+func formatConfigError(err error) string {
+	lines := strings.Split(err.Error(), "\n")
+	return "  - " + strings.Join(lines, "\n  - ")
+}
+
+// envOverrides applies environment variables to configuration fields,
+// collecting parse errors instead of stopping at the first one.
+type envOverrides struct {
+	lookupEnv func(string) (string, bool)
+	errs      []error
+}
+
+// Func calls apply with the value of key if it is set.
+func (e *envOverrides) Func(key string, apply func(string) error) {
+	value, ok := e.lookupEnv(key)
+	if !ok || value == "" {
+		return
+	}
+	if err := apply(value); err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+func (e *envOverrides) String(key string, dst *string) {
+	e.Func(key, func(v string) error {
+		*dst = v
+		return nil
+	})
+}
+
+func (e *envOverrides) Int(key string, dst *int) {
+	e.Func(key, func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", v)
+		}
+		*dst = i
+		return nil
+	})
+}
+
+func (e *envOverrides) Bool(key string, dst *bool) {
+	e.Func(key, func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("must be a boolean, got %q", v)
+		}
+		*dst = b
+		return nil
+	})
+}
+
+func (e *envOverrides) Duration(key string, dst *time.Duration) {
+	e.Func(key, func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 30s or 5m, got %q", v)
+		}
+		*dst = d
+		return nil
+	})
+}
+
+// parseTime parses a time given in RFC 3339 format or as a date, which
+// is taken as midnight UTC. An empty string is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a date such as 2024-01-31 nor a time such as 2024-01-31T12:00:00Z", s)
+	}
+	return t, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	return Filter(Map(strings.Split(s, ","), strings.TrimSpace), func(v string) bool {
+		return v != ""
+	})
+}
+
+// parseListMap parses semicolon-separated key=values entries, where values is
+// a comma-separated list, e.g. domain2.tld=a@domain2.tld,b@domain2.tld;domain3.tld=drop.
+func parseListMap(s string) (map[string]stringList, error) {
+	m := make(map[string]stringList)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, values, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected key=values", entry)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("invalid entry %q: %q is listed more than once", entry, key)
+		}
+		m[key] = splitList(values)
+	}
+	return m, nil
+}
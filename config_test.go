@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envMap returns a lookupEnv function backed by env.
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+queues:
+  - url: https://sqs.us-east-1.amazonaws.com/123456789012/inbound-a
+  - url: https://sqs.us-east-1.amazonaws.com/123456789012/inbound-b
+workerCount: 8
+visibilityTimeout: 2m
+backfill:
+  bucket: ses-mail
+  markerFile: /var/lib/ses2lmtp/processed
+  since: 2024-01-31
+sns:
+  topicArns: [arn:aws:sns:us-east-1:123456789012:ses-inbound]
+recipients:
+  mailboxes: [user@example.com, "*@example.org"]
+  defaultMailbox: user@example.com
+  aliases:
+    sales@example.com: [alice@example.com, bob@example.com]
+    info@example.com: alice@example.com
+  catchAll:
+    example.net: drop
+delivery:
+  lmtp:
+    hosts: [mail1:24, mail2:24]
+    from: ses@example.com
+    routes:
+      example.org: unix:///run/dovecot/lmtp
+`)
+
+	cfg, err := loadConfig(path, envMap(nil))
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	expectedQueues := []QueueConfig{
+		{URL: "https://sqs.us-east-1.amazonaws.com/123456789012/inbound-a"},
+		{URL: "https://sqs.us-east-1.amazonaws.com/123456789012/inbound-b"},
+	}
+	if !reflect.DeepEqual(cfg.Queues, expectedQueues) {
+		t.Errorf("Queues = %v, want %v", cfg.Queues, expectedQueues)
+	}
+	if cfg.WorkerCount != 8 {
+		t.Errorf("WorkerCount = %v, want %v", cfg.WorkerCount, 8)
+	}
+	if cfg.VisibilityTimeout != 2*time.Minute {
+		t.Errorf("VisibilityTimeout = %v, want %v", cfg.VisibilityTimeout, 2*time.Minute)
+	}
+	// Unset values keep their defaults
+	if cfg.ShutdownTimeout != 30*time.Second {
+		t.Errorf("ShutdownTimeout = %v, want %v", cfg.ShutdownTimeout, 30*time.Second)
+	}
+	if expected := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC); !cfg.Backfill.Since.Equal(expected) {
+		t.Errorf("Backfill.Since = %v, want %v", cfg.Backfill.Since, expected)
+	}
+	if cfg.Backfill.MinAge != 15*time.Minute {
+		t.Errorf("Backfill.MinAge = %v, want %v", cfg.Backfill.MinAge, 15*time.Minute)
+	}
+	if cfg.SNS.SignatureVerification != snsVerificationRequire {
+		t.Errorf("SNS.SignatureVerification = %v, want %v", cfg.SNS.SignatureVerification, snsVerificationRequire)
+	}
+	expectedTopics := []string{"arn:aws:sns:us-east-1:123456789012:ses-inbound"}
+	if !reflect.DeepEqual(cfg.SNS.TopicArns, expectedTopics) {
+		t.Errorf("SNS.TopicArns = %v, want %v", cfg.SNS.TopicArns, expectedTopics)
+	}
+	if cfg.Delivery.Protocol != deliveryProtocolLMTP {
+		t.Errorf("Delivery.Protocol = %v, want %v", cfg.Delivery.Protocol, deliveryProtocolLMTP)
+	}
+	expectedAliases := map[string]stringList{
+		"sales@example.com": {"alice@example.com", "bob@example.com"},
+		"info@example.com":  {"alice@example.com"},
+	}
+	if !reflect.DeepEqual(cfg.Recipients.Aliases, expectedAliases) {
+		t.Errorf("Recipients.Aliases = %v, want %v", cfg.Recipients.Aliases, expectedAliases)
+	}
+	expectedRoutes := map[string]stringList{"example.org": {"unix:///run/dovecot/lmtp"}}
+	if !reflect.DeepEqual(cfg.Delivery.LMTP.Routes, expectedRoutes) {
+		t.Errorf("Delivery.LMTP.Routes = %v, want %v", cfg.Delivery.LMTP.Routes, expectedRoutes)
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+queues:
+  - url: https://sqs.us-east-1.amazonaws.com/123456789012/from-file
+workerCount: 8
+sns:
+  topicArns: [arn:aws:sns:us-east-1:123456789012:from-file]
+recipients:
+  mailboxes: [user@example.com]
+  defaultMailbox: user@example.com
+delivery:
+  lmtp:
+    hosts: [mail1:24]
+    from: ses@example.com
+`)
+
+	cfg, err := loadConfig(path, envMap(map[string]string{
+		"SQS_QUEUE_URL":     "https://sqs.us-east-1.amazonaws.com/123456789012/a, https://sqs.us-east-1.amazonaws.com/123456789012/b",
+		"WORKER_COUNT":      "2",
+		"MAILBOXES":         "other@example.com,/^(sales|info)@example\\.com$/",
+		"LMTP_ROUTES":       "example.org=mail2:24,mail3:24",
+		"SNS_TOPIC_ARNS":    "arn:aws:sns:us-east-1:123456789012:a,arn:aws-cn:sns:cn-north-1:123456789012:b",
+		"HEALTH_CHECK_PORT": "",
+	}))
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if len(cfg.Queues) != 2 || cfg.Queues[1].URL != "https://sqs.us-east-1.amazonaws.com/123456789012/b" {
+		t.Errorf("Queues = %v, want the two queues from SQS_QUEUE_URL", cfg.Queues)
+	}
+	if cfg.WorkerCount != 2 {
+		t.Errorf("WorkerCount = %v, want %v", cfg.WorkerCount, 2)
+	}
+	expectedMailboxes := []string{"other@example.com", `/^(sales|info)@example\.com$/`}
+	if !reflect.DeepEqual(cfg.Recipients.Mailboxes, expectedMailboxes) {
+		t.Errorf("Recipients.Mailboxes = %v, want %v", cfg.Recipients.Mailboxes, expectedMailboxes)
+	}
+	expectedRoutes := map[string]stringList{"example.org": {"mail2:24", "mail3:24"}}
+	if !reflect.DeepEqual(cfg.Delivery.LMTP.Routes, expectedRoutes) {
+		t.Errorf("Delivery.LMTP.Routes = %v, want %v", cfg.Delivery.LMTP.Routes, expectedRoutes)
+	}
+	expectedTopics := []string{"arn:aws:sns:us-east-1:123456789012:a", "arn:aws-cn:sns:cn-north-1:123456789012:b"}
+	if !reflect.DeepEqual(cfg.SNS.TopicArns, expectedTopics) {
+		t.Errorf("SNS.TopicArns = %v, want %v", cfg.SNS.TopicArns, expectedTopics)
+	}
+	// An empty variable doesn't override the default
+	if cfg.HealthCheckPort != "8080" {
+		t.Errorf("HealthCheckPort = %v, want %v", cfg.HealthCheckPort, "8080")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		expected []string
+	}{
+		{
+			name: "unknown field",
+			file: "queues: []\nworkers: 4\n",
+			expected: []string{
+				"field workers not found",
+			},
+		},
+		{
+			name: "malformed environment variables",
+			env: map[string]string{
+				"WORKER_COUNT":       "four",
+				"VISIBILITY_TIMEOUT": "60",
+				"BACKFILL_SINCE":     "last week",
+			},
+			expected: []string{
+				`WORKER_COUNT: must be an integer, got "four"`,
+				`VISIBILITY_TIMEOUT: must be a duration such as 30s or 5m, got "60"`,
+				`BACKFILL_SINCE: "last week" is neither a date`,
+			},
+		},
+		{
+			name: "every problem is reported",
+			env: map[string]string{
+				"WORKER_COUNT":      "0",
+				"DELIVERY_PROTOCOL": "lmtp",
+				"LMTP_BALANCE":      "random",
+			},
+			expected: []string{
+				"queues: at least one queue is required (SQS_QUEUE_URL)",
+				"workerCount (WORKER_COUNT): must be at least 1",
+				"recipients.mailboxes (MAILBOXES): at least one mailbox is required",
+				"recipients.defaultMailbox (DEFAULT_MAILBOX): is required",
+				"delivery.lmtp.hosts (LMTP_HOST): is required unless routes are configured",
+				"delivery.lmtp.from (LMTP_FROM): is required",
+				`delivery.lmtp.balance (LMTP_BALANCE): unknown strategy "random"`,
+				"sns.topicArns (SNS_TOPIC_ARNS): required unless sns.signatureVerification is off",
+			},
+		},
+		{
+			name: "invalid recipients",
+			env: map[string]string{
+				"SQS_QUEUE_URL":   "https://sqs.us-east-1.amazonaws.com/123456789012/inbound",
+				"MAILBOXES":       "/[/",
+				"DEFAULT_MAILBOX": "user@example.com",
+				"CATCH_ALL":       "example.com=discard",
+				"SUBADDRESS_MODE": "folders",
+				"LMTP_HOST":       "mail:24",
+				"LMTP_FROM":       "ses@example.com",
+			},
+			expected: []string{
+				"recipients.mailboxes (MAILBOXES): invalid mailbox pattern",
+				"recipients.subaddress.mode (SUBADDRESS_MODE): unknown subaddress mode",
+				`recipients.catchAll (CATCH_ALL): invalid catch-all "example.com"`,
+			},
+		},
+		{
+			name: "backfill and sns settings",
+			env: map[string]string{
+				"BACKFILL_INTERVAL":          "1h",
+				"BACKFILL_MIN_AGE":           "-1m",
+				"SNS_SIGNATURE_VERIFICATION": "strict",
+				"SNS_TOPIC_ARNS":             "arn:aws:sqs:us-east-1:123456789012:inbound",
+			},
+			expected: []string{
+				"backfill.bucket (BACKFILL_BUCKET): is required",
+				"backfill.minAge (BACKFILL_MIN_AGE): must not be negative",
+				`sns.signatureVerification (SNS_SIGNATURE_VERIFICATION): unknown verification mode "strict"`,
+				`sns.topicArns (SNS_TOPIC_ARNS): invalid sns topic arn "arn:aws:sqs:us-east-1:123456789012:inbound"`,
+			},
+		},
+		{
+			name: "smtp settings",
+			env: map[string]string{
+				"SQS_QUEUE_URL":     "https://sqs.us-east-1.amazonaws.com/123456789012/inbound",
+				"MAILBOXES":         "user@example.com",
+				"DEFAULT_MAILBOX":   "user@example.com",
+				"DELIVERY_PROTOCOL": "smtp",
+				"SMTP_HOST":         "smtp.example.com",
+				"SMTP_USERNAME":     "ses",
+			},
+			expected: []string{
+				"delivery.smtp.host (SMTP_HOST):",
+				"delivery.smtp.auth (SMTP_USERNAME, SMTP_PASSWORD, SMTP_AUTH_MECHANISM): a password is required with a username",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file)
+			}
+			_, err := loadConfig(path, envMap(tt.env))
+			if err == nil {
+				t.Fatal("loadConfig() error = nil, want an error")
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("loadConfig() error = %v, want it to contain %q", err, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestParseListMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string]stringList
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[string]stringList{},
+		},
+		{
+			name:  "entries",
+			input: "example.com=a@example.com, b@example.com; example.org=drop;",
+			expected: map[string]stringList{
+				"example.com": {"a@example.com", "b@example.com"},
+				"example.org": {"drop"},
+			},
+		},
+		{
+			name:      "missing values",
+			input:     "example.com",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate key",
+			input:     "example.com=a@example.com;example.com=b@example.com",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseListMap(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseListMap() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseListMap() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  time.Time
+		expectErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+		},
+		{
+			name:     "date",
+			input:    "2024-01-31",
+			expected: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "time",
+			input:    "2024-01-31T12:30:00Z",
+			expected: time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC),
+		},
+		{
+			name:      "invalid",
+			input:     "yesterday",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseTime(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseTime() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !result.Equal(tt.expected) {
+				t.Errorf("parseTime() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatConfigError(t *testing.T) {
+	err := errors.Join(
+		errors.New("workerCount (WORKER_COUNT): must be at least 1"),
+		errors.Join(errors.New("LMTP_POOL_SIZE: must be an integer, got \"x\"")),
+	)
+	expected := "  - workerCount (WORKER_COUNT): must be at least 1\n  - LMTP_POOL_SIZE: must be an integer, got \"x\""
+	if result := formatConfigError(err); result != expected {
+		t.Errorf("formatConfigError() = %q, want %q", result, expected)
+	}
+}
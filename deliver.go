@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// Delivery protocols
+	deliveryProtocolLMTP = "lmtp"
+	deliveryProtocolSMTP = "smtp"
+)
+
+// Envelope describes a single delivery: who a message is from, who it should
+// be delivered to, and the SES metadata it was received with.
+type Envelope struct {
+	// From is the envelope sender of the original message.
+	From string
+	// Recipients are the mailboxes the message should be delivered to.
+	Recipients []string
+	// Mail and Receipt are the SES notification the message arrived with.
+	Mail    events.SimpleEmailMessage
+	Receipt events.SimpleEmailReceipt
+}
+
+// Deliverer hands a message over to a mail server or store. Deliverers that
+// hold connections open also implement io.Closer.
+//
+// Deliver returns nil once every recipient has accepted the message. If only
+// some of them did, it returns a recipientErrors holding the recipients that
+// didn't; any other error means nobody accepted it.
+type Deliverer interface {
+	Deliver(ctx context.Context, envelope Envelope, body io.Reader) error
+}
+
+// backendReporter is implemented by Deliverers that report the state of their
+// backends in /stats.json.
+type backendReporter interface {
+	Stats() []backendStats
+}
+
+// defaultHeloName returns the name to greet SMTP servers with when none is
+// configured.
+func defaultHeloName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// newDeliverer returns the Deliverer selected and configured by cfg.
+func newDeliverer(cfg DeliveryConfig) (Deliverer, error) {
+	switch cfg.Protocol {
+	case deliveryProtocolLMTP:
+		l := cfg.LMTP
+		endpoints, routes, err := lmtpEndpoints(l)
+		if err != nil {
+			return nil, err
+		}
+		allEndpoints := endpoints
+		for _, routeEndpoints := range routes {
+			allEndpoints = append(allEndpoints, routeEndpoints...)
+		}
+		opts, err := lmtpClientOptions(l)
+		if err != nil {
+			return nil, err
+		}
+		if opts.auth != nil {
+			unixOnly := !slices.ContainsFunc(allEndpoints, func(e endpoint) bool { return e.network != "unix" })
+			if opts.tlsMode != tlsModeRequired && opts.tlsMode != tlsModeImplicit && !unixOnly {
+				slog.Warn("lmtp credentials may be sent in plaintext, set LMTP_TLS=required or LMTP_TLS=implicit to prevent this")
+			}
+		}
+		lmtpOpts := lmtpOptions{
+			balance:          l.Balance,
+			poolSize:         l.PoolSize,
+			poolIdleTimeout:  l.PoolIdleTimeout,
+			probeInterval:    l.ProbeInterval,
+			failureThreshold: l.FailureThreshold,
+			breakerCooldown:  l.BreakerCooldown,
+		}
+		slog.Info("delivering over lmtp", "lmtpHost", endpoints, "balance", lmtpOpts.balance, "lmtpFrom", l.From, "tls", opts.tlsMode, "auth", opts.auth != nil, "poolSize", lmtpOpts.poolSize, "poolIdleTimeout", lmtpOpts.poolIdleTimeout, "probeInterval", lmtpOpts.probeInterval)
+		if len(routes) == 0 {
+			return newLMTPDeliverer(endpoints, l.From, opts, lmtpOpts), nil
+		}
+
+		// Routes to the same servers share a deliverer, and with it their
+		// session pools and health state
+		backends := make(map[string]Deliverer)
+		backend := func(endpoints []endpoint) Deliverer {
+			key := fmt.Sprint(endpoints)
+			if _, ok := backends[key]; !ok {
+				backends[key] = newLMTPDeliverer(endpoints, l.From, opts, lmtpOpts)
+			}
+			return backends[key]
+		}
+		routed := make(map[string]Deliverer, len(routes))
+		for match, routeEndpoints := range routes {
+			slog.Info("routing lmtp recipients", "match", match, "lmtpHost", routeEndpoints)
+			routed[match] = backend(routeEndpoints)
+		}
+		var fallback Deliverer
+		if len(endpoints) > 0 {
+			fallback = backend(endpoints)
+		}
+		return newRoutedDeliverer(routed, fallback), nil
+	case deliveryProtocolSMTP:
+		s := cfg.SMTP
+		opts, err := smtpClientOptions(s)
+		if err != nil {
+			return nil, err
+		}
+		if opts.auth != nil && opts.tlsMode != tlsModeRequired && opts.tlsMode != tlsModeImplicit {
+			slog.Warn("smtp credentials may be sent in plaintext, set SMTP_STARTTLS=required or SMTP_STARTTLS=implicit to prevent this")
+		}
+		slog.Info("delivering over smtp", "smtpHost", s.Host, "smtpFrom", s.From, "heloName", opts.heloName, "startTLS", opts.tlsMode, "auth", opts.auth != nil)
+		return newSMTPDeliverer(s.Host, s.From, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown delivery protocol %q", cfg.Protocol)
+	}
+}
+
+// lmtpEndpoints returns the default LMTP servers and the routing table of l.
+// The default servers are only optional when every recipient is expected to
+// match a route.
+func lmtpEndpoints(l LMTPConfig) ([]endpoint, map[string][]endpoint, error) {
+	routes, err := newRoutes(l.Routes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid lmtp routes: %w", err)
+	}
+	var endpoints []endpoint
+	if len(l.Hosts) > 0 || len(routes) == 0 {
+		endpoints, err = parseEndpoints(strings.Join(l.Hosts, ","))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid lmtp hosts: %w", err)
+		}
+	}
+	return endpoints, routes, nil
+}
+
+// lmtpClientOptions returns the session options for the LMTP servers of l.
+func lmtpClientOptions(l LMTPConfig) (clientOptions, error) {
+	opts := clientOptions{
+		lmtp:    true,
+		tlsMode: l.TLS.Mode,
+	}
+	if err := validateTLSMode(opts.tlsMode); err != nil {
+		return opts, fmt.Errorf("invalid lmtp tls mode: %w", err)
+	}
+	var err error
+	if opts.tlsMode != tlsModeNone {
+		// Without an explicit server name each backend's certificate is
+		// verified against its own host
+		opts.tlsConfig, err = newTLSConfig(l.TLS.ServerName, l.TLS.CAFile, l.TLS.CertFile, l.TLS.KeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("invalid LMTP tls configuration: %w", err)
+		}
+	}
+	if l.Auth.Username != "" {
+		opts.auth, err = newSASLClient(l.Auth.Mechanism, l.Auth.Username, l.Auth.Password)
+		if err != nil {
+			return opts, fmt.Errorf("invalid lmtp auth mechanism: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// smtpClientOptions returns the session options for the SMTP relay of s.
+func smtpClientOptions(s SMTPConfig) (clientOptions, error) {
+	opts := clientOptions{
+		heloName: s.HeloName,
+		tlsMode:  s.StartTLS,
+	}
+	if err := validateTLSMode(opts.tlsMode); err != nil {
+		return opts, fmt.Errorf("invalid smtp starttls mode: %w", err)
+	}
+	serverName, _, err := net.SplitHostPort(s.Host)
+	if err != nil {
+		return opts, fmt.Errorf("invalid smtp host: %w", err)
+	}
+	opts.tlsConfig, err = newTLSConfig(serverName, "", "", "")
+	if err != nil {
+		return opts, fmt.Errorf("invalid SMTP tls configuration: %w", err)
+	}
+	if s.Auth.Username != "" {
+		opts.auth, err = newSASLClient(s.Auth.Mechanism, s.Auth.Username, s.Auth.Password)
+		if err != nil {
+			return opts, fmt.Errorf("invalid smtp auth mechanism: %w", err)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+)
+
+// doctorReceiptHandle is a receipt handle no message has. Deleting a message
+// or changing its visibility with it is refused as invalid when the caller is
+// allowed to do either, and as access denied otherwise, so permissions can be
+// checked without touching any message.
+const doctorReceiptHandle = "ses2lmtp-doctor"
+
+// doctorSQSAPI is the subset of the SQS client used by the doctor command.
+type doctorSQSAPI interface {
+	sqsVisibilityAPI
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// doctor runs checks against the services the configuration points at and
+// prints a line for each result.
+type doctor struct {
+	out io.Writer
+	// timeout bounds each network check.
+	timeout time.Duration
+
+	passed, failed, skipped int
+}
+
+func (d *doctor) pass(check, format string, args ...any) {
+	d.passed++
+	fmt.Fprintf(d.out, "PASS  %-14s  %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(check, format string, args ...any) {
+	d.failed++
+	fmt.Fprintf(d.out, "FAIL  %-14s  %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) skip(check, format string, args ...any) {
+	d.skipped++
+	fmt.Fprintf(d.out, "SKIP  %-14s  %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// summary prints the totals and returns the exit status.
+func (d *doctor) summary() int {
+	fmt.Fprintf(d.out, "\n%d passed, %d failed, %d skipped\n", d.passed, d.failed, d.skipped)
+	if d.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// doctorCommand checks that the configured queues, S3 bucket and mail servers
+// are reachable and usable, exiting non-zero if any check fails.
+func doctorCommand(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("doctor", stderr)
+	configPath := configFlag(flags)
+	bucket := flags.String("s3-bucket", "", "bucket of a sample SES message to check S3 read access with")
+	key := flags.String("s3-key", "", "key of a sample SES message to check S3 read access with")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout for each check")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	d := &doctor{out: stdout, timeout: *timeout}
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		d.fail("config", "invalid configuration:\n%s", formatConfigError(err))
+		return d.summary()
+	}
+	d.pass("config", "configuration is valid")
+
+	ctx := context.Background()
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		d.fail("aws", "failed to load aws config: %v", err)
+	} else {
+		d.checkQueues(ctx, sqs.NewFromConfig(awsConfig), cfg)
+		d.checkS3Object(ctx, s3.NewFromConfig(awsConfig), *bucket, *key)
+	}
+	d.checkDelivery(ctx, cfg)
+	return d.summary()
+}
+
+// checkQueues checks that every queue exists and that its messages can be
+// deleted and have their visibility changed. Receiving can't be checked
+// without taking messages off the queue, so it isn't.
+func (d *doctor) checkQueues(ctx context.Context, client doctorSQSAPI, cfg *Config) {
+	for _, queue := range cfg.Queues {
+		d.checkQueueAttributes(ctx, client, "sqs queue", queue.URL)
+		d.checkQueuePermission(ctx, "sqs delete", queue.URL, func(ctx context.Context) error {
+			_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(queue.URL),
+				ReceiptHandle: aws.String(doctorReceiptHandle),
+			})
+			return err
+		})
+		d.checkQueuePermission(ctx, "sqs visibility", queue.URL, func(ctx context.Context) error {
+			_, err := client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(queue.URL),
+				ReceiptHandle:     aws.String(doctorReceiptHandle),
+				VisibilityTimeout: 0,
+			})
+			return err
+		})
+	}
+	if cfg.Retry.DeadLetterQueueURL != "" {
+		d.checkQueueAttributes(ctx, client, "sqs dlq", cfg.Retry.DeadLetterQueueURL)
+	}
+}
+
+func (d *doctor) checkQueueAttributes(ctx context.Context, client doctorSQSAPI, check, queueURL string) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	out, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []sqsTypes.QueueAttributeName{sqsTypes.QueueAttributeNameAll},
+	})
+	if err != nil {
+		d.fail(check, "%s: %v", queueURL, err)
+		return
+	}
+	details := []string{"reachable"}
+	for _, attribute := range []struct {
+		name   sqsTypes.QueueAttributeName
+		format string
+	}{
+		{sqsTypes.QueueAttributeNameApproximateNumberOfMessages, "%s messages waiting"},
+		{sqsTypes.QueueAttributeNameApproximateNumberOfMessagesNotVisible, "%s in flight"},
+		{sqsTypes.QueueAttributeNameVisibilityTimeout, "visibility timeout %ss"},
+	} {
+		if value, ok := out.Attributes[string(attribute.name)]; ok {
+			details = append(details, fmt.Sprintf(attribute.format, value))
+		}
+	}
+	if out.Attributes[string(sqsTypes.QueueAttributeNameRedrivePolicy)] != "" {
+		details = append(details, "has a redrive policy")
+	}
+	d.pass(check, "%s: %s", queueURL, strings.Join(details, ", "))
+}
+
+// checkQueuePermission calls an action with doctorReceiptHandle, which only
+// an allowed caller gets an invalid receipt handle error for.
+func (d *doctor) checkQueuePermission(ctx context.Context, check, queueURL string, action func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	err := action(ctx)
+	var invalidHandle *sqsTypes.ReceiptHandleIsInvalid
+	var apiErr smithy.APIError
+	switch {
+	case err == nil,
+		errors.As(err, &invalidHandle),
+		errors.As(err, &apiErr) && (apiErr.ErrorCode() == "ReceiptHandleIsInvalid" || apiErr.ErrorCode() == "InvalidParameterValue"):
+		d.pass(check, "%s: allowed", queueURL)
+	default:
+		d.fail(check, "%s: %v", queueURL, err)
+	}
+}
+
+// checkS3Object reads the first bytes of a sample message.
+func (d *doctor) checkS3Object(ctx context.Context, client s3ObjectAPI, bucket, key string) {
+	if bucket == "" || key == "" {
+		d.skip("s3 read", "no sample message given, use -s3-bucket and -s3-key")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=0-1023"),
+	})
+	if err != nil {
+		d.fail("s3 read", "s3://%s/%s: %v", bucket, key, err)
+		return
+	}
+	defer out.Body.Close()
+	if _, err := io.Copy(io.Discard, out.Body); err != nil {
+		d.fail("s3 read", "s3://%s/%s: %v", bucket, key, err)
+		return
+	}
+	d.pass("s3 read", "s3://%s/%s: readable", bucket, key)
+}
+
+// checkDelivery connects to every configured mail server and probes the
+// mailboxes routed to it with RCPT, without sending a message.
+func (d *doctor) checkDelivery(ctx context.Context, cfg *Config) {
+	mailboxes := probeMailboxes(cfg.Recipients)
+	if slices.ContainsFunc(cfg.Recipients.Mailboxes, func(m string) bool { return !isExactMailbox(m) }) {
+		d.skip("rcpt", "wildcard and regular expression mailboxes can't be probed")
+	}
+
+	switch cfg.Delivery.Protocol {
+	case deliveryProtocolLMTP:
+		l := cfg.Delivery.LMTP
+		endpoints, routes, err := lmtpEndpoints(l)
+		if err != nil {
+			d.fail("lmtp", "%v", err)
+			return
+		}
+		opts, err := lmtpClientOptions(l)
+		if err != nil {
+			d.fail("lmtp", "%v", err)
+			return
+		}
+
+		// Every server is checked, in the order of the configuration, with
+		// the mailboxes that are routed to it
+		var servers []endpoint
+		routed := make(map[endpoint][]string)
+		addServers := func(endpoints []endpoint) {
+			for _, e := range endpoints {
+				if _, ok := routed[e]; !ok {
+					routed[e] = nil
+					servers = append(servers, e)
+				}
+			}
+		}
+		addServers(endpoints)
+		for _, match := range slices.Sorted(maps.Keys(routes)) {
+			addServers(routes[match])
+		}
+		for _, mailbox := range mailboxes {
+			mailboxEndpoints, ok := lookupRoute(routes, mailbox)
+			if !ok {
+				mailboxEndpoints = endpoints
+			}
+			if len(mailboxEndpoints) == 0 {
+				d.fail("lmtp rcpt", "%s: no route and no default lmtp host", mailbox)
+				continue
+			}
+			for _, e := range mailboxEndpoints {
+				routed[e] = append(routed[e], mailbox)
+			}
+		}
+		for _, e := range servers {
+			d.probeServer(ctx, "lmtp", e, backendClientOptions(opts, e), l.From, routed[e])
+		}
+	case deliveryProtocolSMTP:
+		s := cfg.Delivery.SMTP
+		opts, err := smtpClientOptions(s)
+		if err != nil {
+			d.fail("smtp", "%v", err)
+			return
+		}
+		d.probeServer(ctx, "smtp", endpoint{network: "tcp", address: s.Host}, opts, s.From, mailboxes)
+	}
+}
+
+// probeServer greets the server at e and offers it each mailbox as a
+// recipient of a transaction that is then reset.
+func (d *doctor) probeServer(ctx context.Context, protocol string, e endpoint, opts clientOptions, from string, mailboxes []string) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	c, err := dialClient(ctx, e.network, e.address, opts)
+	if err != nil {
+		d.fail(protocol+" connect", "%s: %v", e, err)
+		return
+	}
+	defer quitClient(c)
+	_, isTLS := c.TLSConnectionState()
+	d.pass(protocol+" connect", "%s: greeting accepted (tls: %t, auth: %t)", e, isTLS, opts.auth != nil)
+
+	if len(mailboxes) == 0 {
+		return
+	}
+	if err := c.Mail(from, nil); err != nil {
+		d.fail(protocol+" rcpt", "%s: MAIL FROM:<%s> refused: %v", e, from, err)
+		return
+	}
+	for _, mailbox := range mailboxes {
+		if err := c.Rcpt(mailbox, nil); err != nil {
+			d.fail(protocol+" rcpt", "%s on %s: %v", mailbox, e, err)
+			continue
+		}
+		d.pass(protocol+" rcpt", "%s on %s: accepted", mailbox, e)
+	}
+	_ = c.Reset()
+}
+
+// probeMailboxes returns the mailboxes that can be probed with RCPT: the exact
+// addresses in MAILBOXES and the default mailbox.
+func probeMailboxes(r RecipientsConfig) []string {
+	var mailboxes []string
+	seen := make(map[string]bool)
+	for _, mailbox := range append(slices.Clone(r.Mailboxes), r.DefaultMailbox) {
+		mailbox = strings.TrimSpace(mailbox)
+		key := normalizeAddress(mailbox, r.CaseSensitiveLocalPart)
+		if !isExactMailbox(mailbox) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		mailboxes = append(mailboxes, mailbox)
+	}
+	return mailboxes
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	smtp "github.com/emersion/go-smtp"
+)
+
+// fakeDoctorSQS answers queue checks as an SQS queue would for a caller with
+// the given permissions.
+type fakeDoctorSQS struct {
+	fakeVisibilityClient
+	queues map[string]map[string]string
+	denied map[string]bool
+}
+
+func (f *fakeDoctorSQS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	attributes, ok := f.queues[*params.QueueUrl]
+	if !ok {
+		return nil, &sqsTypes.QueueDoesNotExist{Message: Pointer("queue does not exist")}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: attributes}, nil
+}
+
+func (f *fakeDoctorSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	if f.denied["DeleteMessage"] {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized"}
+	}
+	return nil, &sqsTypes.ReceiptHandleIsInvalid{Message: Pointer("invalid receipt handle")}
+}
+
+func (f *fakeDoctorSQS) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if f.denied["ChangeMessageVisibility"] {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized"}
+	}
+	return nil, &smithy.GenericAPIError{Code: "ReceiptHandleIsInvalid", Message: "invalid receipt handle"}
+}
+
+type fakeDoctorS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeDoctorS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[*params.Bucket+"/"+*params.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+// reportLines returns the status and check of each line of a doctor report.
+func reportLines(out string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 20 {
+			continue
+		}
+		lines = append(lines, line[:4]+" "+strings.TrimSpace(line[6:20]))
+	}
+	return lines
+}
+
+func TestDoctorCheckQueues(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Queues = []QueueConfig{{URL: "https://sqs/inbound"}, {URL: "https://sqs/missing"}}
+	cfg.Retry.DeadLetterQueueURL = "https://sqs/failed"
+	client := &fakeDoctorSQS{
+		queues: map[string]map[string]string{
+			"https://sqs/inbound": {"ApproximateNumberOfMessages": "3", "VisibilityTimeout": "30"},
+			"https://sqs/failed":  {},
+		},
+		denied: map[string]bool{"ChangeMessageVisibility": true},
+	}
+
+	var out bytes.Buffer
+	d := &doctor{out: &out, timeout: time.Second}
+	d.checkQueues(context.Background(), client, cfg)
+
+	expected := []string{
+		"PASS sqs queue", "PASS sqs delete", "FAIL sqs visibility",
+		"FAIL sqs queue", "PASS sqs delete", "FAIL sqs visibility",
+		"PASS sqs dlq",
+	}
+	if result := reportLines(out.String()); !reflect.DeepEqual(result, expected) {
+		t.Errorf("checkQueues() report = %v, want %v\n%s", result, expected, out.String())
+	}
+	if !strings.Contains(out.String(), "3 messages waiting") {
+		t.Errorf("checkQueues() report = %q, want the queue depth", out.String())
+	}
+}
+
+func TestDoctorCheckS3Object(t *testing.T) {
+	client := &fakeDoctorS3{objects: map[string]string{"mail/inbound/abc": "From: a@example.com\r\n"}}
+
+	tests := []struct {
+		name     string
+		bucket   string
+		key      string
+		expected string
+	}{
+		{name: "readable", bucket: "mail", key: "inbound/abc", expected: "PASS s3 read"},
+		{name: "missing", bucket: "mail", key: "inbound/def", expected: "FAIL s3 read"},
+		{name: "no sample", expected: "SKIP s3 read"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			d := &doctor{out: &out, timeout: time.Second}
+			d.checkS3Object(context.Background(), client, tt.bucket, tt.key)
+			if result := reportLines(out.String()); !reflect.DeepEqual(result, []string{tt.expected}) {
+				t.Errorf("checkS3Object() report = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoctorCheckDelivery(t *testing.T) {
+	unknownUser := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	backend := &testMailBackend{rcptErrors: map[string]error{"gone@example.com": unknownUser}}
+	routedBackend := &testMailBackend{}
+	addr := startTestMailServer(t, backend, true, nil)
+	routedAddr := startTestMailServer(t, routedBackend, true, nil)
+
+	cfg := defaultConfig()
+	cfg.Recipients.Mailboxes = []string{"user@example.com", "gone@example.com", "*@example.net", "ceo@example.org"}
+	cfg.Recipients.DefaultMailbox = "USER@example.com"
+	cfg.Delivery.LMTP.Hosts = []string{addr, closedEndpoint(t).address}
+	cfg.Delivery.LMTP.From = "ses@example.com"
+	cfg.Delivery.LMTP.Routes = map[string]stringList{"example.org": {routedAddr}}
+
+	var out bytes.Buffer
+	d := &doctor{out: &out, timeout: time.Second}
+	d.checkDelivery(context.Background(), cfg)
+
+	expected := []string{
+		"SKIP rcpt",
+		"PASS lmtp connect", "PASS lmtp rcpt", "FAIL lmtp rcpt",
+		"FAIL lmtp connect",
+		"PASS lmtp connect", "PASS lmtp rcpt",
+	}
+	if result := reportLines(out.String()); !reflect.DeepEqual(result, expected) {
+		t.Errorf("checkDelivery() report = %v, want %v\n%s", result, expected, out.String())
+	}
+	if d.failed != 2 || d.summary() != 1 {
+		t.Errorf("checkDelivery() failed = %d, want 2 and a non-zero exit status", d.failed)
+	}
+	if len(backend.deliveries("user@example.com")) != 0 {
+		t.Errorf("checkDelivery() delivered a message")
+	}
+}
+
+func TestProbeMailboxes(t *testing.T) {
+	r := RecipientsConfig{
+		Mailboxes:      []string{"user@example.com", "*@example.net", "/^(sales|info)@example\\.com$/", "other@example.com"},
+		DefaultMailbox: "User@Example.com",
+	}
+	expected := []string{"user@example.com", "other@example.com"}
+	if result := probeMailboxes(r); !reflect.DeepEqual(result, expected) {
+		t.Errorf("probeMailboxes() = %v, want %v", result, expected)
+	}
+}
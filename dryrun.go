@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// dryRunDeliverer logs which servers a message would be delivered to instead
+// of delivering it. It never connects to a mail server.
+type dryRunDeliverer struct {
+	protocol string
+	// defaults receive recipients without a route. It is empty when every
+	// recipient is expected to match a route.
+	defaults []endpoint
+	routes   map[string][]endpoint
+}
+
+// newDryRunDeliverer returns a dryRunDeliverer that routes recipients as the
+// Deliverer configured by cfg would. The TLS and AUTH settings are checked
+// like they would be for a real run.
+func newDryRunDeliverer(cfg DeliveryConfig) (Deliverer, error) {
+	switch cfg.Protocol {
+	case deliveryProtocolLMTP:
+		endpoints, routes, err := lmtpEndpoints(cfg.LMTP)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := lmtpClientOptions(cfg.LMTP); err != nil {
+			return nil, err
+		}
+		return &dryRunDeliverer{protocol: cfg.Protocol, defaults: endpoints, routes: routes}, nil
+	case deliveryProtocolSMTP:
+		if _, err := smtpClientOptions(cfg.SMTP); err != nil {
+			return nil, err
+		}
+		relay := endpoint{network: "tcp", address: cfg.SMTP.Host}
+		return &dryRunDeliverer{protocol: cfg.Protocol, defaults: []endpoint{relay}}, nil
+	default:
+		return nil, fmt.Errorf("unknown delivery protocol %q", cfg.Protocol)
+	}
+}
+
+// Plan groups recipients by the servers they would be delivered to, keyed by
+// the comma-separated server list. Recipients without a route are returned
+// separately.
+func (d *dryRunDeliverer) Plan(recipients []string) (map[string][]string, []string) {
+	plan := make(map[string][]string)
+	var unrouted []string
+	for _, rcpt := range recipients {
+		endpoints, ok := lookupRoute(d.routes, rcpt)
+		if !ok {
+			endpoints = d.defaults
+		}
+		if len(endpoints) == 0 {
+			unrouted = append(unrouted, rcpt)
+			continue
+		}
+		servers := make([]string, len(endpoints))
+		for i, e := range endpoints {
+			servers[i] = e.String()
+		}
+		key := strings.Join(servers, ",")
+		plan[key] = append(plan[key], rcpt)
+	}
+	return plan, unrouted
+}
+
+// Deliver logs the delivery plan for envelope. Like a routedDeliverer it
+// fails the recipients without a route.
+func (d *dryRunDeliverer) Deliver(ctx context.Context, envelope Envelope, body io.Reader) error {
+	plan, unrouted := d.Plan(envelope.Recipients)
+	slog.Info("dry run, skipping delivery", "protocol", d.protocol, "from", envelope.From, "routes", plan)
+	if len(unrouted) == 0 {
+		return nil
+	}
+	rcptErrs := make(recipientErrors, len(unrouted))
+	for _, rcpt := range unrouted {
+		rcptErrs[rcpt] = permanent(fmt.Errorf("%w %s", errNoRoute, rcpt))
+	}
+	return rcptErrs
+}
+
+// newDryRunHandler returns a worker handler for dry runs. It processes a
+// message and logs the outcome, but never deletes the message or applies the
+// failure policy to it. With resetVisibility the message is made visible again
+// straight away, so that the queue's other consumers don't have to wait for
+// the visibility timeout to receive it.
+func newDryRunHandler(
+	sqsClient sqsVisibilityAPI,
+	resetVisibility bool,
+	processMessage func(ctx context.Context, message sqsTypes.Message) error,
+) func(ctx context.Context, job queuedMessage) {
+	return func(ctx context.Context, job queuedMessage) {
+		message := job.message
+		logger := slog.With("messageId", Value(message.MessageId), "queueURL", job.queueURL, "dryRun", true)
+
+		logger.Info("processing message")
+		if err := processMessage(ctx, message); err != nil {
+			logger.Warn("dry run, message would fail", "err", err, "retryable", isRetryable(err))
+		} else {
+			logger.Info("dry run, message would be delivered and deleted")
+		}
+		if job.stopHeartbeat != nil {
+			job.stopHeartbeat()
+		}
+		if !resetVisibility {
+			return
+		}
+
+		_, err := sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(job.queueURL),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: 0,
+		})
+		if err != nil {
+			logger.Warn("failed to reset message visibility", "err", err)
+			return
+		}
+		logger.Info("reset message visibility")
+	}
+}
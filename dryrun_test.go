@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func TestDryRunDelivererPlan(t *testing.T) {
+	tests := []struct {
+		name             string
+		delivery         DeliveryConfig
+		recipients       []string
+		expected         map[string][]string
+		expectedUnrouted []string
+	}{
+		{
+			name: "lmtp routes",
+			delivery: DeliveryConfig{
+				Protocol: deliveryProtocolLMTP,
+				LMTP: LMTPConfig{
+					Hosts: []string{"mail1:24", "mail2:24"},
+					Routes: map[string]stringList{
+						"example.org":     {"unix:///run/dovecot/lmtp"},
+						"ceo@example.com": {"mail3:24"},
+					},
+				},
+			},
+			recipients: []string{"a@example.com", "CEO@example.com", "b@example.org", "c@example.com"},
+			expected: map[string][]string{
+				"tcp://mail1:24,tcp://mail2:24": {"a@example.com", "c@example.com"},
+				"tcp://mail3:24":                {"CEO@example.com"},
+				"unix:///run/dovecot/lmtp":      {"b@example.org"},
+			},
+		},
+		{
+			name: "lmtp without default hosts",
+			delivery: DeliveryConfig{
+				Protocol: deliveryProtocolLMTP,
+				LMTP: LMTPConfig{
+					Routes: map[string]stringList{"example.org": {"mail1:24"}},
+				},
+			},
+			recipients:       []string{"a@example.org", "b@example.com"},
+			expected:         map[string][]string{"tcp://mail1:24": {"a@example.org"}},
+			expectedUnrouted: []string{"b@example.com"},
+		},
+		{
+			name: "smtp relay",
+			delivery: DeliveryConfig{
+				Protocol: deliveryProtocolSMTP,
+				SMTP:     SMTPConfig{Host: "smtp.example.com:587", StartTLS: tlsModeOpportunistic},
+			},
+			recipients: []string{"a@example.com", "b@example.org"},
+			expected:   map[string][]string{"tcp://smtp.example.com:587": {"a@example.com", "b@example.org"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.delivery.LMTP.TLS.Mode == "" {
+				tt.delivery.LMTP.TLS.Mode = tlsModeNone
+			}
+			deliverer, err := newDryRunDeliverer(tt.delivery)
+			if err != nil {
+				t.Fatalf("newDryRunDeliverer() error = %v", err)
+			}
+			result, unrouted := deliverer.(*dryRunDeliverer).Plan(tt.recipients)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Plan() = %v, want %v", result, tt.expected)
+			}
+			if !reflect.DeepEqual(unrouted, tt.expectedUnrouted) {
+				t.Errorf("Plan() unrouted = %v, want %v", unrouted, tt.expectedUnrouted)
+			}
+		})
+	}
+}
+
+func TestDryRunDelivererDeliver(t *testing.T) {
+	deliverer, err := newDryRunDeliverer(DeliveryConfig{
+		Protocol: deliveryProtocolLMTP,
+		LMTP: LMTPConfig{
+			Routes: map[string]stringList{"example.org": {"mail1:24"}},
+			TLS:    TLSConfig{Mode: tlsModeNone},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newDryRunDeliverer() error = %v", err)
+	}
+
+	envelope := Envelope{From: "sender@example.net", Recipients: []string{"a@example.org", "b@example.com"}}
+	err = deliverer.Deliver(context.Background(), envelope, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	var rcptErrs recipientErrors
+	if !errors.As(err, &rcptErrs) {
+		t.Fatalf("Deliver() error = %v, want recipientErrors", err)
+	}
+	if _, ok := rcptErrs["b@example.com"]; !ok || len(rcptErrs) != 1 {
+		t.Errorf("Deliver() failed recipients = %v, want only b@example.com", rcptErrs)
+	}
+	if !errors.Is(err, errNoRoute) {
+		t.Errorf("Deliver() error = %v, want errNoRoute", err)
+	}
+}
+
+func TestDryRunHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		resetVisibility bool
+		processErr      error
+		expectedCalls   int
+	}{
+		{
+			name:          "keeps visibility",
+			expectedCalls: 0,
+		},
+		{
+			name:            "resets visibility",
+			resetVisibility: true,
+			expectedCalls:   1,
+		},
+		{
+			name:            "resets visibility of failed messages",
+			resetVisibility: true,
+			processErr:      permanent(errors.New("malformed")),
+			expectedCalls:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeVisibilityClient{}
+			processed := 0
+			handle := newDryRunHandler(client, tt.resetVisibility, func(ctx context.Context, message sqsTypes.Message) error {
+				processed++
+				return tt.processErr
+			})
+			stopped := false
+			handle(context.Background(), queuedMessage{
+				queueURL:      "https://sqs.us-east-1.amazonaws.com/123456789012/inbound",
+				message:       sqsTypes.Message{MessageId: aws.String("1"), ReceiptHandle: aws.String("handle")},
+				stopHeartbeat: func() { stopped = true },
+			})
+
+			if processed != 1 {
+				t.Errorf("processed %d times, want 1", processed)
+			}
+			if !stopped {
+				t.Errorf("heartbeat wasn't stopped")
+			}
+			if result := client.callCount(); result != tt.expectedCalls {
+				t.Fatalf("ChangeMessageVisibility() calls = %v, want %v", result, tt.expectedCalls)
+			}
+			if tt.expectedCalls > 0 {
+				call := client.calls[0]
+				if call.VisibilityTimeout != 0 || Value(call.ReceiptHandle) != "handle" {
+					t.Errorf("ChangeMessageVisibility() = timeout %v for %q, want 0 for %q", call.VisibilityTimeout, Value(call.ReceiptHandle), "handle")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// endpoint is a network address that a mail server listens on.
+type endpoint struct {
+	network string
+	address string
+}
+
+func (e endpoint) String() string {
+	return e.network + "://" + e.address
+}
+
+// parseEndpoint parses a server address given as unix:///path/to/socket,
+// tcp://host:port or a bare host:port.
+func parseEndpoint(s string) (endpoint, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		path := strings.TrimPrefix(s, "unix://")
+		if !strings.HasPrefix(path, "/") {
+			return endpoint{}, fmt.Errorf("invalid endpoint %q: unix socket path must be absolute", s)
+		}
+		return endpoint{network: "unix", address: path}, nil
+	case strings.HasPrefix(s, "tcp://"):
+		s = strings.TrimPrefix(s, "tcp://")
+	case strings.Contains(s, "://"):
+		return endpoint{}, fmt.Errorf("invalid endpoint %q: scheme must be unix:// or tcp://", s)
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("invalid endpoint %q: %w", s, err)
+	}
+	if host == "" || port == "" {
+		return endpoint{}, fmt.Errorf("invalid endpoint %q: host and port are required", s)
+	}
+	return endpoint{network: "tcp", address: s}, nil
+}
+
+// parseEndpoints parses a comma-separated list of endpoints.
+func parseEndpoints(s string) ([]endpoint, error) {
+	var endpoints []endpoint
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		e, err := parseEndpoint(field)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints given")
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  endpoint
+		expectErr bool
+	}{
+		{
+			name:     "bare host and port",
+			input:    "192.168.0.123:31024",
+			expected: endpoint{network: "tcp", address: "192.168.0.123:31024"},
+		},
+		{
+			name:     "tcp scheme",
+			input:    "tcp://mail.example.com:24",
+			expected: endpoint{network: "tcp", address: "mail.example.com:24"},
+		},
+		{
+			name:     "ipv6 host",
+			input:    "tcp://[::1]:24",
+			expected: endpoint{network: "tcp", address: "[::1]:24"},
+		},
+		{
+			name:     "unix socket",
+			input:    "unix:///var/run/dovecot/lmtp",
+			expected: endpoint{network: "unix", address: "/var/run/dovecot/lmtp"},
+		},
+		{
+			name:     "surrounding whitespace",
+			input:    " unix:///var/run/dovecot/lmtp ",
+			expected: endpoint{network: "unix", address: "/var/run/dovecot/lmtp"},
+		},
+		{
+			name:      "relative unix socket",
+			input:     "unix://var/run/dovecot/lmtp",
+			expectErr: true,
+		},
+		{
+			name:      "missing port",
+			input:     "tcp://mail.example.com",
+			expectErr: true,
+		},
+		{
+			name:      "missing host",
+			input:     ":24",
+			expectErr: true,
+		},
+		{
+			name:      "unknown scheme",
+			input:     "udp://mail.example.com:24",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseEndpoint(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseEndpoint() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if result != tt.expected {
+				t.Errorf("parseEndpoint() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  []endpoint
+		expectErr bool
+	}{
+		{
+			name:     "single endpoint",
+			input:    "192.168.0.123:31024",
+			expected: []endpoint{{network: "tcp", address: "192.168.0.123:31024"}},
+		},
+		{
+			name:  "multiple endpoints",
+			input: "tcp://mail1.example.com:24, unix:///var/run/dovecot/lmtp,",
+			expected: []endpoint{
+				{network: "tcp", address: "mail1.example.com:24"},
+				{network: "unix", address: "/var/run/dovecot/lmtp"},
+			},
+		},
+		{
+			name:      "invalid endpoint",
+			input:     "tcp://mail1.example.com:24,udp://mail2.example.com:24",
+			expectErr: true,
+		},
+		{
+			name:      "empty",
+			input:     " , ",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseEndpoints(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseEndpoints() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseEndpoints() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
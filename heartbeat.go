@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// sqsVisibilityAPI is the subset of the SQS client used to extend the
+// visibility timeout of in-flight messages.
+type sqsVisibilityAPI interface {
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// startHeartbeat periodically resets the visibility timeout of a message to
+// timeout so that SQS doesn't hand it to another consumer while it is still
+// being processed. The timeout is extended every third of its length, leaving
+// room for a failed call to be retried before the message becomes visible.
+//
+// The returned function stops the heartbeat and waits for it to exit. It must
+// be called before the message is deleted or its visibility is changed.
+func startHeartbeat(ctx context.Context, client sqsVisibilityAPI, queueURL string, receiptHandle *string, timeout time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(timeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(queueURL),
+					ReceiptHandle:     receiptHandle,
+					VisibilityTimeout: int32(timeout.Seconds()),
+				})
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					slog.Warn("failed to extend message visibility", "err", err)
+					continue
+				}
+				slog.Debug("extended message visibility", "timeout", timeout)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+type fakeVisibilityClient struct {
+	mu    sync.Mutex
+	calls []*sqs.ChangeMessageVisibilityInput
+	err   error
+}
+
+func (f *fakeVisibilityClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, params)
+	return &sqs.ChangeMessageVisibilityOutput{}, f.err
+}
+
+func (f *fakeVisibilityClient) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	client := &fakeVisibilityClient{}
+	stop := startHeartbeat(context.Background(), client, "queue", Pointer("receipt"), 3*time.Second)
+
+	time.Sleep(2500 * time.Millisecond)
+	stop()
+	calls := client.callCount()
+	if calls != 2 {
+		t.Errorf("ChangeMessageVisibility() called %v times, want 2", calls)
+	}
+
+	for _, call := range client.calls {
+		if Value(call.QueueUrl) != "queue" || Value(call.ReceiptHandle) != "receipt" || call.VisibilityTimeout != 3 {
+			t.Errorf("ChangeMessageVisibility() input = %+v", call)
+		}
+	}
+
+	// No more calls once stopped.
+	time.Sleep(1100 * time.Millisecond)
+	if client.callCount() != calls {
+		t.Errorf("ChangeMessageVisibility() called after stop")
+	}
+}
+
+func TestStartHeartbeatKeepsGoingOnError(t *testing.T) {
+	client := &fakeVisibilityClient{err: errors.New("throttled")}
+	stop := startHeartbeat(context.Background(), client, "queue", Pointer("receipt"), 3*time.Second)
+
+	time.Sleep(2500 * time.Millisecond)
+	stop()
+	if calls := client.callCount(); calls != 2 {
+		t.Errorf("ChangeMessageVisibility() called %v times, want 2", calls)
+	}
+}
+
+func TestStartHeartbeatStopsWithContext(t *testing.T) {
+	client := &fakeVisibilityClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := startHeartbeat(ctx, client, "queue", Pointer("receipt"), 3*time.Second)
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stop() did not return after context was cancelled")
+	}
+	if calls := client.callCount(); calls != 0 {
+		t.Errorf("ChangeMessageVisibility() called %v times, want 0", calls)
+	}
+}
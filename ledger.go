@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deliveryLedger remembers which recipients of a partially delivered message
+// have already accepted it, so that a retry only goes to the recipients that
+// failed. Entries are removed once a message is fully delivered or after ttl.
+//
+// The ledger is kept in memory, so a restart or a retry picked up by another
+// consumer will redeliver to every recipient.
+type deliveryLedger struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*ledgerEntry
+}
+
+type ledgerEntry struct {
+	delivered map[string]bool
+	updated   time.Time
+}
+
+func newDeliveryLedger(ttl time.Duration) *deliveryLedger {
+	return &deliveryLedger{
+		ttl:     ttl,
+		entries: make(map[string]*ledgerEntry),
+	}
+}
+
+// Pending returns the recipients that haven't yet accepted message id.
+func (l *deliveryLedger) Pending(id string, recipients []string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[id]
+	if !ok || time.Since(entry.updated) > l.ttl {
+		return recipients
+	}
+	return Filter(recipients, func(r string) bool {
+		return !entry.delivered[r]
+	})
+}
+
+// Record marks recipients as having accepted message id.
+func (l *deliveryLedger) Record(id string, recipients []string) {
+	if len(recipients) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire()
+	entry, ok := l.entries[id]
+	if !ok {
+		entry = &ledgerEntry{delivered: make(map[string]bool)}
+		l.entries[id] = entry
+	}
+	for _, r := range recipients {
+		entry.delivered[r] = true
+	}
+	entry.updated = time.Now()
+}
+
+// Forget removes message id from the ledger.
+func (l *deliveryLedger) Forget(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, id)
+}
+
+// expire removes entries older than the ttl. The caller must hold l.mu.
+func (l *deliveryLedger) expire() {
+	for id, entry := range l.entries {
+		if time.Since(entry.updated) > l.ttl {
+			delete(l.entries, id)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeliveryLedger(t *testing.T) {
+	recipients := []string{"a@example.com", "b@example.com", "c@example.com"}
+
+	ledger := newDeliveryLedger(time.Hour)
+	if pending := ledger.Pending("msg", recipients); len(pending) != 3 {
+		t.Errorf("Pending() = %v, want all recipients", pending)
+	}
+
+	ledger.Record("msg", []string{"a@example.com", "c@example.com"})
+	pending := ledger.Pending("msg", recipients)
+	if len(pending) != 1 || pending[0] != "b@example.com" {
+		t.Errorf("Pending() = %v, want [b@example.com]", pending)
+	}
+	if pending := ledger.Pending("other", recipients); len(pending) != 3 {
+		t.Errorf("Pending() for another message = %v, want all recipients", pending)
+	}
+
+	ledger.Forget("msg")
+	if pending := ledger.Pending("msg", recipients); len(pending) != 3 {
+		t.Errorf("Pending() after Forget() = %v, want all recipients", pending)
+	}
+}
+
+func TestDeliveryLedgerExpiry(t *testing.T) {
+	ledger := newDeliveryLedger(10 * time.Millisecond)
+	ledger.Record("msg", []string{"a@example.com"})
+	time.Sleep(20 * time.Millisecond)
+
+	if pending := ledger.Pending("msg", []string{"a@example.com"}); len(pending) != 1 {
+		t.Errorf("Pending() after expiry = %v, want [a@example.com]", pending)
+	}
+
+	ledger.Record("other", []string{"a@example.com"})
+	if _, ok := ledger.entries["msg"]; ok {
+		t.Errorf("expired entry was not removed")
+	}
+}
+
+func TestMessageProcessorRetriesFailedRecipients(t *testing.T) {
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"a@example.com", "b@example.com", "c@example.com"},
+		DefaultMailbox: "a@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{errs: map[string]error{"b@example.com": errors.New("mailbox busy")}}
+	processMessage := newMessageProcessor(&emailPipeline{
+		live:   newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+		ledger: newDeliveryLedger(time.Hour),
+	})
+
+	content, _ := json.Marshal(testEmail)
+	message := snsMessage(t, `{
+  "notificationType": "Received",
+  "mail": {"source": "sender@example.net", "messageId": "ses-1"},
+  "receipt": {"recipients": ["a@example.com", "b@example.com", "c@example.com"], "action": {"type": "SNS", "encoding": "UTF8"}},
+  "content": `+string(content)+`
+}`)
+
+	err = processMessage(context.Background(), message)
+	if err == nil || !isRetryable(err) {
+		t.Fatalf("processMessage() error = %v, want a retryable error", err)
+	}
+
+	// The retry only goes to the recipient that failed
+	deliverer.errs = nil
+	if err := processMessage(context.Background(), message); err != nil {
+		t.Fatalf("processMessage() error = %v on retry", err)
+	}
+	expected := [][]string{
+		{"a@example.com", "b@example.com", "c@example.com"},
+		{"b@example.com"},
+	}
+	if !reflect.DeepEqual(deliverer.calls, expected) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expected)
+	}
+}
+
+func TestMessageProcessorDeliversOnceWithRejectedRecipients(t *testing.T) {
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"a@example.com"},
+		DefaultMailbox: "a@example.com",
+		CatchAll:       map[string]stringList{"junk.tld": {catchAllReject}},
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{}
+	processMessage := newMessageProcessor(&emailPipeline{
+		live:   newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+		ledger: newDeliveryLedger(time.Hour),
+	})
+
+	content, _ := json.Marshal(testEmail)
+	message := snsMessage(t, `{
+  "notificationType": "Received",
+  "mail": {"source": "sender@example.net", "messageId": "ses-1"},
+  "receipt": {"recipients": ["a@example.com", "unknown@junk.tld"], "action": {"type": "SNS", "encoding": "UTF8"}},
+  "content": `+string(content)+`
+}`)
+
+	// However often the message comes back, the recipient that accepted it
+	// only gets it once
+	for attempt := range 4 {
+		err := processMessage(context.Background(), message)
+		var deliveredErr *deliveredError
+		if !errors.Is(err, errRejected) || !errors.As(err, &deliveredErr) || isRetryable(err) {
+			t.Fatalf("processMessage() attempt %d error = %v, want a permanent delivered error", attempt+1, err)
+		}
+	}
+	expected := [][]string{{"a@example.com"}}
+	if !reflect.DeepEqual(deliverer.calls, expected) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expected)
+	}
+}
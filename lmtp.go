@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+const (
+	// LMTP backend selection strategies
+	balancePriority   = "priority"
+	balanceRoundRobin = "round-robin"
+)
+
+// errNoBackends is returned when every LMTP backend's circuit breaker is open.
+var errNoBackends = errors.New("no healthy lmtp backends available")
+
+// lmtpOptions configures how an lmtpDeliverer uses its backends.
+type lmtpOptions struct {
+	// balance is balancePriority to prefer backends in the order they were
+	// given, or balanceRoundRobin to spread deliveries across them.
+	balance string
+	// poolSize and poolIdleTimeout configure each backend's session pool.
+	poolSize        int
+	poolIdleTimeout time.Duration
+	// probeInterval is how often backends are health checked. Zero disables
+	// probing.
+	probeInterval time.Duration
+	// failureThreshold consecutive failures open a backend's circuit breaker
+	// for breakerCooldown.
+	failureThreshold int
+	breakerCooldown  time.Duration
+}
+
+// lmtpDeliverer delivers messages to one or more LMTP servers such as Dovecot.
+// If a backend can't be reached the message is sent to the next one.
+type lmtpDeliverer struct {
+	from     string
+	backends []*lmtpBackend
+	balance  string
+	next     atomic.Uint64
+
+	stopProbe context.CancelFunc
+	probeDone chan struct{}
+}
+
+// lmtpBackend is a single LMTP server with its own session pool and circuit
+// breaker.
+type lmtpBackend struct {
+	endpoint endpoint
+	opts     clientOptions
+	pool     *clientPool
+	breaker  *circuitBreaker
+
+	mu        sync.Mutex
+	lastProbe time.Time
+}
+
+// backendStats is the state of an LMTP backend as reported in /stats.json.
+type backendStats struct {
+	Endpoint            string     `json:"endpoint"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastProbe           *time.Time `json:"lastProbe,omitempty"`
+}
+
+// newLMTPDeliverer returns a Deliverer for the LMTP servers listening on
+// endpoints. Messages are sent with from as the MAIL FROM address, or with the
+// envelope sender if from is empty.
+func newLMTPDeliverer(endpoints []endpoint, from string, opts clientOptions, lmtpOpts lmtpOptions) *lmtpDeliverer {
+	opts.lmtp = true
+	d := &lmtpDeliverer{
+		from:    from,
+		balance: lmtpOpts.balance,
+	}
+	for _, e := range endpoints {
+		b := &lmtpBackend{
+			endpoint: e,
+			opts:     backendClientOptions(opts, e),
+			breaker:  newCircuitBreaker(lmtpOpts.failureThreshold, lmtpOpts.breakerCooldown),
+		}
+		b.pool = newClientPool(b.dial, lmtpOpts.poolSize, lmtpOpts.poolIdleTimeout)
+		d.backends = append(d.backends, b)
+	}
+
+	if lmtpOpts.probeInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		d.stopProbe = cancel
+		d.probeDone = make(chan struct{})
+		go d.probeBackends(ctx, lmtpOpts.probeInterval)
+	}
+	return d
+}
+
+// backendClientOptions returns opts for connecting to e. Unless a TLS server
+// name was configured explicitly, certificates are verified against the host
+// of a TCP endpoint.
+func backendClientOptions(opts clientOptions, e endpoint) clientOptions {
+	if opts.tlsConfig == nil || opts.tlsConfig.ServerName != "" || e.network != "tcp" {
+		return opts
+	}
+	host, _, err := net.SplitHostPort(e.address)
+	if err != nil {
+		return opts
+	}
+	opts.tlsConfig = opts.tlsConfig.Clone()
+	opts.tlsConfig.ServerName = host
+	return opts
+}
+
+func (d *lmtpDeliverer) Deliver(ctx context.Context, envelope Envelope, body io.Reader) error {
+	from := d.from
+	if from == "" {
+		from = envelope.From
+	}
+
+	// The body is needed again if the first backend fails
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read message body: %w", err)
+	}
+
+	err = errNoBackends
+	for _, b := range d.candidates() {
+		if !b.breaker.Allow() {
+			continue
+		}
+		err = b.deliver(ctx, from, envelope.Recipients, bytes.NewReader(data))
+		if !backendFailed(err) {
+			b.breaker.Success()
+			return err
+		}
+		b.breaker.Failure(err)
+		if ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("lmtp backend failed, trying next backend", "lmtpHost", b.endpoint, "err", err)
+	}
+	return err
+}
+
+// candidates returns the backends in the order they should be tried.
+func (d *lmtpDeliverer) candidates() []*lmtpBackend {
+	if d.balance != balanceRoundRobin || len(d.backends) < 2 {
+		return d.backends
+	}
+	start := int(d.next.Add(1)-1) % len(d.backends)
+	return append(d.backends[start:len(d.backends):len(d.backends)], d.backends[:start]...)
+}
+
+// backendFailed reports whether err means the backend couldn't take the
+// message at all, so that it should be sent to another backend. A 421 reply
+// means the server is shutting down; other replies are answers about the
+// message itself and every backend would give the same one. Partial
+// deliveries are never retried elsewhere, as that would deliver the message
+// twice to the recipients that accepted it.
+func backendFailed(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code == 421 {
+		return true
+	}
+	return !sessionUsable(err)
+}
+
+// Stats returns the state of each backend.
+func (d *lmtpDeliverer) Stats() []backendStats {
+	stats := make([]backendStats, 0, len(d.backends))
+	for _, b := range d.backends {
+		state, failures, lastErr := b.breaker.State()
+		s := backendStats{
+			Endpoint:            b.endpoint.String(),
+			State:               state,
+			ConsecutiveFailures: failures,
+		}
+		if lastErr != nil {
+			s.LastError = lastErr.Error()
+		}
+		b.mu.Lock()
+		if !b.lastProbe.IsZero() {
+			s.LastProbe = Pointer(b.lastProbe)
+		}
+		b.mu.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// probeBackends health checks every backend each interval until ctx is done.
+func (d *lmtpDeliverer) probeBackends(ctx context.Context, interval time.Duration) {
+	defer close(d.probeDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, b := range d.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.probe(ctx, interval)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// Close stops probing and closes the idle sessions held by the deliverer.
+func (d *lmtpDeliverer) Close() error {
+	if d.stopProbe != nil {
+		d.stopProbe()
+		<-d.probeDone
+	}
+	var errs []error
+	for _, b := range d.backends {
+		errs = append(errs, b.pool.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (b *lmtpBackend) dial(ctx context.Context) (*smtp.Client, error) {
+	return dialClient(ctx, b.endpoint.network, b.endpoint.address, b.opts)
+}
+
+func (b *lmtpBackend) deliver(ctx context.Context, from string, to []string, body io.Reader) error {
+	lmtpClient, err := b.pool.Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Abort the transaction if the context is cancelled mid-delivery
+	stop := context.AfterFunc(ctx, func() {
+		_ = lmtpClient.Close()
+	})
+
+	err = sendMail(lmtpClient.Client, true, from, to, body)
+	b.pool.Put(lmtpClient, stop() && sessionUsable(err))
+	return err
+}
+
+// probe opens a new session, greets the server with LHLO and checks it with
+// NOOP. The result is recorded in the backend's circuit breaker, so a probe
+// can close an open breaker without waiting for a delivery to succeed.
+func (b *lmtpBackend) probe(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := func() error {
+		c, err := b.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer quitClient(c)
+		return c.Noop()
+	}()
+	// The deliverer is being closed
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	b.mu.Lock()
+	b.lastProbe = time.Now()
+	b.mu.Unlock()
+
+	if err != nil {
+		if state, _, _ := b.breaker.State(); state == breakerClosed {
+			slog.Warn("lmtp backend probe failed", "lmtpHost", b.endpoint, "err", err)
+		}
+		b.breaker.Failure(err)
+		return
+	}
+	if state, _, _ := b.breaker.State(); state != breakerClosed {
+		slog.Info("lmtp backend recovered", "lmtpHost", b.endpoint)
+	}
+	b.breaker.Success()
+}
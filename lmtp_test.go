@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	smtp "github.com/emersion/go-smtp"
+)
+
+// testMailBackend is an in-process LMTP/SMTP backend that records accepted
+// messages and rejects recipients on demand.
+type testMailBackend struct {
+	mu         sync.Mutex
+	rcptErrors map[string]error
+	dataErrors map[string]error
+	delivered  map[string][]string
+
+	// username and password enable AUTH PLAIN when set.
+	username string
+	password string
+
+	// Greeting names and TLS state seen by the server, one per session.
+	helloNames []string
+	tlsStates  []bool
+}
+
+func (b *testMailBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	_, isTLS := c.TLSConnectionState()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.helloNames = append(b.helloNames, c.Hostname())
+	b.tlsStates = append(b.tlsStates, isTLS)
+	return &testMailSession{backend: b}, nil
+}
+
+func (b *testMailBackend) deliveries(rcpt string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.delivered[rcpt]
+}
+
+type testMailSession struct {
+	backend       *testMailBackend
+	rcpts         []string
+	authenticated bool
+}
+
+func (s *testMailSession) AuthMechanisms() []string {
+	if s.backend.username == "" {
+		return nil
+	}
+	return []string{sasl.Plain}
+}
+
+func (s *testMailSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != s.backend.username || password != s.backend.password {
+			return smtp.ErrAuthFailed
+		}
+		s.authenticated = true
+		return nil
+	}), nil
+}
+
+func (s *testMailSession) Reset()        { s.rcpts = nil }
+func (s *testMailSession) Logout() error { return nil }
+func (s *testMailSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.backend.username != "" && !s.authenticated {
+		return smtp.ErrAuthRequired
+	}
+	return nil
+}
+
+func (s *testMailSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.backend.rcptErrors[to]; err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *testMailSession) Data(r io.Reader) error {
+	return s.LMTPData(r, nil)
+}
+
+func (s *testMailSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	if s.backend.delivered == nil {
+		s.backend.delivered = make(map[string][]string)
+	}
+	for _, rcpt := range s.rcpts {
+		err := s.backend.dataErrors[rcpt]
+		if err == nil {
+			s.backend.delivered[rcpt] = append(s.backend.delivered[rcpt], string(body))
+		}
+		if status != nil {
+			status.SetStatus(rcpt, err)
+		}
+	}
+	return nil
+}
+
+// startTestMailServer serves backend over LMTP or SMTP on a local port and
+// returns its address. STARTTLS is offered if tlsConfig is not nil.
+func startTestMailServer(t *testing.T, backend *testMailBackend, lmtp bool, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := smtp.NewServer(backend)
+	server.LMTP = lmtp
+	server.Domain = "localhost"
+	server.AllowInsecureAuth = true
+	server.TLSConfig = tlsConfig
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String()
+}
+
+func TestLMTPDeliverer(t *testing.T) {
+	overQuota := &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "mailbox full"}
+	unknownUser := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+
+	tests := []struct {
+		name       string
+		to         []string
+		rcptErrors map[string]error
+		dataErrors map[string]error
+		delivered  []string
+		failed     map[string]int
+	}{
+		{
+			name:      "all recipients accept",
+			to:        []string{"a@example.com", "b@example.com"},
+			delivered: []string{"a@example.com", "b@example.com"},
+		},
+		{
+			name:       "one recipient rejected at data",
+			to:         []string{"a@example.com", "b@example.com"},
+			dataErrors: map[string]error{"b@example.com": overQuota},
+			delivered:  []string{"a@example.com"},
+			failed:     map[string]int{"b@example.com": 452},
+		},
+		{
+			name:       "one recipient rejected at rcpt",
+			to:         []string{"a@example.com", "b@example.com"},
+			rcptErrors: map[string]error{"a@example.com": unknownUser},
+			delivered:  []string{"b@example.com"},
+			failed:     map[string]int{"a@example.com": 550},
+		},
+		{
+			name:       "all recipients rejected at rcpt",
+			to:         []string{"a@example.com"},
+			rcptErrors: map[string]error{"a@example.com": unknownUser},
+			failed:     map[string]int{"a@example.com": 550},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &testMailBackend{rcptErrors: tt.rcptErrors, dataErrors: tt.dataErrors}
+			addr := startTestMailServer(t, backend, true, nil)
+
+			deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: addr}}, "from@example.com", clientOptions{}, lmtpOptions{})
+			err := deliverer.Deliver(context.Background(), Envelope{Recipients: tt.to}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+
+			var rcptErrs recipientErrors
+			if len(tt.failed) == 0 {
+				if err != nil {
+					t.Fatalf("send error = %v, want nil", err)
+				}
+			} else if !errors.As(err, &rcptErrs) {
+				t.Fatalf("send error = %v, want recipientErrors", err)
+			}
+
+			if len(rcptErrs) != len(tt.failed) {
+				t.Errorf("failed recipients = %v, want %v", rcptErrs, tt.failed)
+			}
+			for rcpt, code := range tt.failed {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(rcptErrs[rcpt], &smtpErr) || smtpErr.Code != code {
+					t.Errorf("error for %s = %v, want code %d", rcpt, rcptErrs[rcpt], code)
+				}
+			}
+			for _, rcpt := range tt.delivered {
+				if len(backend.deliveries(rcpt)) != 1 {
+					t.Errorf("deliveries to %s = %d, want 1", rcpt, len(backend.deliveries(rcpt)))
+				}
+			}
+		})
+	}
+}
+
+func TestRecipientErrorsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      recipientErrors
+		expected bool
+	}{
+		{
+			name: "all permanent",
+			err: recipientErrors{
+				"a@example.com": &smtp.SMTPError{Code: 550},
+				"b@example.com": &smtp.SMTPError{Code: 552},
+			},
+			expected: false,
+		},
+		{
+			name: "one transient",
+			err: recipientErrors{
+				"a@example.com": &smtp.SMTPError{Code: 550},
+				"b@example.com": &smtp.SMTPError{Code: 452},
+			},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := isRetryable(tt.err); result != tt.expected {
+				t.Errorf("isRetryable() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLMTPDelivererUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lmtp")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	backend := &testMailBackend{}
+	server := smtp.NewServer(backend)
+	server.LMTP = true
+	server.Domain = "localhost"
+	go server.Serve(l)
+	defer server.Close()
+
+	e, err := parseEndpoint("unix://" + path)
+	if err != nil {
+		t.Fatalf("parseEndpoint() error = %v", err)
+	}
+	deliverer := newLMTPDeliverer([]endpoint{e}, "from@example.com", clientOptions{}, lmtpOptions{})
+	if err := deliverer.Deliver(context.Background(), Envelope{Recipients: []string{"a@example.com"}}, strings.NewReader("Subject: test\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if len(backend.deliveries("a@example.com")) != 1 {
+		t.Errorf("deliveries = %d, want 1", len(backend.deliveries("a@example.com")))
+	}
+}
+
+// writeTestCertificate writes cert as PEM certificate and key files and
+// returns their paths.
+func writeTestCertificate(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestLMTPDelivererTLS(t *testing.T) {
+	serverCert, _ := newTestCertificate(t)
+	clientCert, clientRoots := newTestCertificate(t)
+	caFile, _ := writeTestCertificate(t, serverCert)
+	clientCertFile, clientKeyFile := writeTestCertificate(t, clientCert)
+
+	tests := []struct {
+		name       string
+		tlsMode    string
+		serverTLS  bool
+		implicit   bool
+		clientAuth bool
+		useCA      bool
+		useCert    bool
+		expectErr  bool
+	}{
+		{
+			name:      "starttls required",
+			tlsMode:   tlsModeRequired,
+			serverTLS: true,
+			useCA:     true,
+		},
+		{
+			name:      "starttls required but not offered",
+			tlsMode:   tlsModeRequired,
+			serverTLS: false,
+			useCA:     true,
+			expectErr: true,
+		},
+		{
+			name:      "starttls with untrusted certificate",
+			tlsMode:   tlsModeRequired,
+			serverTLS: true,
+			useCA:     false,
+			expectErr: true,
+		},
+		{
+			name:      "implicit tls",
+			tlsMode:   tlsModeImplicit,
+			implicit:  true,
+			useCA:     true,
+			expectErr: false,
+		},
+		{
+			name:       "mutual tls",
+			tlsMode:    tlsModeImplicit,
+			implicit:   true,
+			clientAuth: true,
+			useCA:      true,
+			useCert:    true,
+		},
+		{
+			name:       "mutual tls without client certificate",
+			tlsMode:    tlsModeImplicit,
+			implicit:   true,
+			clientAuth: true,
+			useCA:      true,
+			expectErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverTLS := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			if tt.clientAuth {
+				serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+				serverTLS.ClientCAs = clientRoots
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			backend := &testMailBackend{}
+			server := smtp.NewServer(backend)
+			server.LMTP = true
+			server.Domain = "localhost"
+			if tt.implicit {
+				l = tls.NewListener(l, serverTLS)
+			} else if tt.serverTLS {
+				server.TLSConfig = serverTLS
+			}
+			go server.Serve(l)
+			defer server.Close()
+
+			var ca, certFile, keyFile string
+			if tt.useCA {
+				ca = caFile
+			}
+			if tt.useCert {
+				certFile, keyFile = clientCertFile, clientKeyFile
+			}
+			tlsConfig, err := newTLSConfig("127.0.0.1", ca, certFile, keyFile)
+			if err != nil {
+				t.Fatalf("newTLSConfig() error = %v", err)
+			}
+
+			deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{
+				tlsMode:   tt.tlsMode,
+				tlsConfig: tlsConfig,
+			}, lmtpOptions{})
+			err = deliverer.Deliver(context.Background(), Envelope{Recipients: []string{"a@example.com"}}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Deliver() error = %v, expectErr %v", err, tt.expectErr)
+			}
+
+			expected := 1
+			if tt.expectErr {
+				expected = 0
+			}
+			if got := len(backend.deliveries("a@example.com")); got != expected {
+				t.Errorf("deliveries = %d, want %d", got, expected)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	certFile, keyFile := writeTestCertificate(t, cert)
+
+	tests := []struct {
+		name      string
+		caFile    string
+		certFile  string
+		keyFile   string
+		expectErr bool
+	}{
+		{name: "system roots"},
+		{name: "custom ca", caFile: certFile},
+		{name: "client certificate", certFile: certFile, keyFile: keyFile},
+		{name: "missing ca file", caFile: filepath.Join(t.TempDir(), "missing.pem"), expectErr: true},
+		{name: "ca file without certificates", caFile: keyFile, expectErr: true},
+		{name: "certificate without key", certFile: certFile, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := newTLSConfig("mail.example.com", tt.caFile, tt.certFile, tt.keyFile)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("newTLSConfig() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.ServerName != "mail.example.com" {
+				t.Errorf("ServerName = %q, want %q", config.ServerName, "mail.example.com")
+			}
+			if (config.RootCAs != nil) != (tt.caFile != "") {
+				t.Errorf("RootCAs set = %v, want %v", config.RootCAs != nil, tt.caFile != "")
+			}
+			if (len(config.Certificates) == 1) != (tt.certFile != "") {
+				t.Errorf("client certificates = %d", len(config.Certificates))
+			}
+		})
+	}
+}
+
+// closedEndpoint returns a TCP endpoint that refuses connections.
+func closedEndpoint(t *testing.T) endpoint {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return endpoint{network: "tcp", address: addr}
+}
+
+func TestLMTPDelivererFailover(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+	down := closedEndpoint(t)
+
+	deliverer := newLMTPDeliverer([]endpoint{down, {network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{
+		failureThreshold: 1,
+		breakerCooldown:  time.Minute,
+	})
+	defer deliverer.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+	if got := len(backend.deliveries("a@example.com")); got != 2 {
+		t.Errorf("deliveries = %d, want 2", got)
+	}
+
+	stats := deliverer.Stats()
+	if stats[0].State != breakerOpen || stats[0].ConsecutiveFailures != 1 || stats[0].LastError == "" {
+		t.Errorf("Stats()[0] = %+v, want an open breaker with one failure", stats[0])
+	}
+	if stats[1].State != breakerClosed || stats[1].ConsecutiveFailures != 0 {
+		t.Errorf("Stats()[1] = %+v, want a closed breaker", stats[1])
+	}
+}
+
+func TestLMTPDelivererNoFailoverOnReply(t *testing.T) {
+	rejected := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	first := &testMailBackend{rcptErrors: map[string]error{"a@example.com": rejected}}
+	second := &testMailBackend{}
+	l1, _ := startCountingLMTPServer(t, first)
+	l2, _ := startCountingLMTPServer(t, second)
+
+	deliverer := newLMTPDeliverer([]endpoint{
+		{network: "tcp", address: l1.Addr().String()},
+		{network: "tcp", address: l2.Addr().String()},
+	}, "from@example.com", clientOptions{}, lmtpOptions{failureThreshold: 1})
+	defer deliverer.Close()
+
+	var rcptErrs recipientErrors
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); !errors.As(err, &rcptErrs) {
+		t.Fatalf("Deliver() error = %v, want recipientErrors", err)
+	}
+	if got := l2.accepted.Load(); got != 0 {
+		t.Errorf("connections to second backend = %d, want 0", got)
+	}
+	if stats := deliverer.Stats(); stats[0].State != breakerClosed {
+		t.Errorf("Stats()[0].State = %v, want %v", stats[0].State, breakerClosed)
+	}
+}
+
+func TestLMTPDelivererRoundRobin(t *testing.T) {
+	first := &testMailBackend{}
+	second := &testMailBackend{}
+	l1, _ := startCountingLMTPServer(t, first)
+	l2, _ := startCountingLMTPServer(t, second)
+
+	deliverer := newLMTPDeliverer([]endpoint{
+		{network: "tcp", address: l1.Addr().String()},
+		{network: "tcp", address: l2.Addr().String()},
+	}, "from@example.com", clientOptions{}, lmtpOptions{balance: balanceRoundRobin})
+	defer deliverer.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+	if got := len(first.deliveries("a@example.com")); got != 2 {
+		t.Errorf("first backend deliveries = %d, want 2", got)
+	}
+	if got := len(second.deliveries("a@example.com")); got != 2 {
+		t.Errorf("second backend deliveries = %d, want 2", got)
+	}
+}
+
+func TestLMTPDelivererAllBackendsDown(t *testing.T) {
+	deliverer := newLMTPDeliverer([]endpoint{closedEndpoint(t)}, "from@example.com", clientOptions{}, lmtpOptions{
+		failureThreshold: 1,
+		breakerCooldown:  time.Minute,
+	})
+	defer deliverer.Close()
+
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); err == nil || errors.Is(err, errNoBackends) {
+		t.Fatalf("Deliver() error = %v, want a connection error", err)
+	}
+	err := deliverTestMessage(t, deliverer, "a@example.com")
+	if !errors.Is(err, errNoBackends) {
+		t.Errorf("Deliver() error = %v, want %v", err, errNoBackends)
+	}
+	if !isRetryable(err) {
+		t.Errorf("isRetryable(%v) = false, want true", err)
+	}
+}
+
+func TestLMTPDelivererProbe(t *testing.T) {
+	backend := &testMailBackend{}
+	l, server := startCountingLMTPServer(t, backend)
+
+	deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{
+		probeInterval:    10 * time.Millisecond,
+		failureThreshold: 1,
+		breakerCooldown:  time.Minute,
+	})
+	defer deliverer.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	stats := deliverer.Stats()
+	if stats[0].State != breakerClosed || stats[0].LastProbe == nil {
+		t.Errorf("Stats()[0] = %+v, want a probed closed breaker", stats[0])
+	}
+
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	if stats := deliverer.Stats(); stats[0].State != breakerOpen {
+		t.Errorf("Stats()[0].State = %v, want %v", stats[0].State, breakerOpen)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+// mailboxMatcher decides whether a recipient is one of the configured
+// mailboxes. A pattern is one of:
+//
+//   - an exact address, e.g. user@example.com
+//   - a wildcard address where * matches any run of characters and ? a single
+//     one, e.g. *@example.com or support-*@example.com
+//   - a regular expression between slashes, e.g. /^(sales|info)@example\.com$/
+//
+// Following RFC 5321, domains are always compared case-insensitively. Local
+// parts are too unless caseSensitiveLocalPart is set, since that is how almost
+// every mail server treats them.
+type mailboxMatcher struct {
+	caseSensitiveLocalPart bool
+	exact                  map[string]bool
+	patterns               []*regexp.Regexp
+}
+
+func newMailboxMatcher(patterns []string, caseSensitiveLocalPart bool) (*mailboxMatcher, error) {
+	m := &mailboxMatcher{
+		caseSensitiveLocalPart: caseSensitiveLocalPart,
+		exact:                  make(map[string]bool),
+	}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		switch {
+		case pattern == "":
+			continue
+		case len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+			expr := pattern[1 : len(pattern)-1]
+			if !caseSensitiveLocalPart {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mailbox pattern %q: %w", pattern, err)
+			}
+			m.patterns = append(m.patterns, re)
+		case strings.ContainsAny(pattern, "*?"):
+			m.patterns = append(m.patterns, wildcardPattern(m.normalize(pattern)))
+		default:
+			m.exact[m.normalize(pattern)] = true
+		}
+	}
+	return m, nil
+}
+
+// isExactMailbox reports whether pattern is a plain address rather than a
+// wildcard or a regular expression.
+func isExactMailbox(pattern string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.ContainsAny(pattern, "*?") {
+		return false
+	}
+	return !(len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"))
+}
+
+// wildcardPattern converts a wildcard address into an anchored regular
+// expression.
+func wildcardPattern(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+func (m *mailboxMatcher) normalize(address string) string {
+	return normalizeAddress(address, m.caseSensitiveLocalPart)
+}
+
+// normalizeAddress lowercases the domain of address, and its local part unless
+// caseSensitiveLocalPart is set.
+func normalizeAddress(address string, caseSensitiveLocalPart bool) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return strings.ToLower(address)
+	}
+	local, domain := address[:i], address[i+1:]
+	if !caseSensitiveLocalPart {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + strings.ToLower(domain)
+}
+
+// Match reports whether address matches any mailbox pattern.
+func (m *mailboxMatcher) Match(address string) bool {
+	address = m.normalize(strings.TrimSpace(address))
+	if m.exact[address] {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMailboxPatterns splits a comma-separated list of mailbox patterns.
+// Commas inside a /regular expression/ don't separate patterns.
+func splitMailboxPatterns(s string) []string {
+	var patterns []string
+	var current strings.Builder
+	inRegexp := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ',' && !inRegexp:
+			patterns = append(patterns, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		case c == '\\' && inRegexp && i+1 < len(s):
+			current.WriteByte(c)
+			i++
+			c = s[i]
+		case c == '/' && strings.TrimSpace(current.String()) == "":
+			inRegexp = true
+		case c == '/' && inRegexp:
+			inRegexp = false
+		}
+		current.WriteByte(c)
+	}
+	return append(patterns, strings.TrimSpace(current.String()))
+}
+
+// recipientResolver turns the recipients of an SES event into the mailboxes
+// the message is delivered to.
+type recipientResolver struct {
+	mailboxes  *mailboxMatcher
+	aliases    *aliasMap
+	subaddress *subaddressConfig
+	// catchAll maps a lowercased domain to what happens to its unknown
+	// recipients.
+	catchAll       map[string]catchAll
+	defaultMailbox string
+}
+
+// newRecipientResolver builds the resolver described by cfg, reading the alias
+// file if there is one. Aliases from the file and the config are merged.
+func newRecipientResolver(cfg RecipientsConfig) (*recipientResolver, error) {
+	var errs []error
+	mailboxes, err := newMailboxMatcher(cfg.Mailboxes, cfg.CaseSensitiveLocalPart)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("recipients.mailboxes (MAILBOXES): %w", err))
+	}
+
+	var aliases *aliasMap
+	if cfg.AliasFile != "" || len(cfg.Aliases) > 0 {
+		targets := make(map[string][]string)
+		if cfg.AliasFile != "" {
+			fileTargets, err := readAliasFile(cfg.AliasFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("recipients.aliasFile (ALIAS_FILE): %w", err))
+			}
+			maps.Copy(targets, fileTargets)
+		}
+		for alias, aliasTargets := range cfg.Aliases {
+			if _, ok := targets[alias]; ok {
+				errs = append(errs, fmt.Errorf("recipients.aliases: alias %q is also defined in the alias file", alias))
+				continue
+			}
+			if len(aliasTargets) == 0 {
+				errs = append(errs, fmt.Errorf("recipients.aliases: alias %q has no targets", alias))
+				continue
+			}
+			targets[alias] = aliasTargets
+		}
+		if aliases, err = newAliasMap(targets, cfg.CaseSensitiveLocalPart); err != nil {
+			errs = append(errs, fmt.Errorf("recipients.aliases: %w", err))
+		}
+	}
+
+	var subaddress *subaddressConfig
+	if err := validateSubaddressMode(cfg.Subaddress.Mode); err != nil {
+		errs = append(errs, fmt.Errorf("recipients.subaddress.mode (SUBADDRESS_MODE): %w", err))
+	}
+	if cfg.Subaddress.Delimiter != "" {
+		subaddress = &subaddressConfig{
+			delimiters: cfg.Subaddress.Delimiter,
+			mode:       cfg.Subaddress.Mode,
+			folders:    make(map[string]string, len(cfg.Subaddress.Folders)),
+		}
+		for detail, folder := range cfg.Subaddress.Folders {
+			subaddress.folders[strings.ToLower(detail)] = folder
+		}
+	}
+
+	catchAll, err := newCatchAll(cfg.CatchAll)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("recipients.catchAll (CATCH_ALL): %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &recipientResolver{
+		mailboxes:      mailboxes,
+		aliases:        aliases,
+		subaddress:     subaddress,
+		catchAll:       catchAll,
+		defaultMailbox: cfg.DefaultMailbox,
+	}, nil
+}
+
+// Resolve returns the mailboxes a message for recipients is delivered to, and
+// the recipients rejected by a catch-all. Aliases are expanded, recipients
+// that are configured mailboxes are kept, and unknown recipients go to their
+// domain's catch-all. If that leaves nothing and some recipient had no
+// catch-all, the message goes to the default mailbox instead. A mailbox
+// reached more than once is only delivered to once.
+func (r *recipientResolver) Resolve(recipients []string) ([]string, recipientErrors) {
+	var resolved []string
+	seen := make(map[string]bool)
+	add := func(mailbox string) {
+		if key := r.mailboxes.normalize(mailbox); !seen[key] {
+			seen[key] = true
+			resolved = append(resolved, mailbox)
+		}
+	}
+
+	rejected := make(recipientErrors)
+	unmatched := 0
+	for _, rcpt := range recipients {
+		if mailboxes, ok := r.resolveRecipient(rcpt); ok {
+			for _, mailbox := range mailboxes {
+				add(mailbox)
+			}
+			continue
+		}
+
+		var domain string
+		if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+			domain = strings.ToLower(rcpt[i+1:])
+		}
+		rule, ok := r.catchAll[domain]
+		switch {
+		case !ok:
+			unmatched++
+		case rule.action == catchAllDrop:
+			slog.Info("dropping recipient by catch-all", "recipient", rcpt)
+		case rule.action == catchAllReject:
+			slog.Info("rejecting recipient by catch-all", "recipient", rcpt)
+			rejected[rcpt] = permanent(fmt.Errorf("%w: %s", errRejected, rcpt))
+		default:
+			slog.Info("delivering recipient to catch-all", "recipient", rcpt, "targets", rule.targets)
+			for _, target := range rule.targets {
+				add(target)
+			}
+		}
+	}
+
+	if len(resolved) == 0 && (unmatched > 0 || len(recipients) == 0) {
+		slog.Info("no valid recipients found, using default mailbox", "defaultMailbox", r.defaultMailbox)
+		return []string{r.defaultMailbox}, rejected
+	}
+	return resolved, rejected
+}
+
+// resolveRecipient returns the mailboxes rcpt is delivered to through an alias
+// or because it is a configured mailbox, and reports false if it is neither.
+//
+// A recipient with a subaddress is looked up as it is first, then by its base
+// address, and the subaddress mode decides whether the detail is passed on.
+// Alias targets are delivered to whether or not they are listed as mailboxes.
+func (r *recipientResolver) resolveRecipient(rcpt string) ([]string, bool) {
+	if targets, ok := r.aliases.Expand(rcpt); ok {
+		slog.Info("expanded alias", "alias", rcpt, "targets", targets)
+		return targets, true
+	}
+
+	base, sub, hasSubaddress := r.subaddress.split(rcpt)
+	if !hasSubaddress {
+		if r.mailboxes.Match(rcpt) {
+			return []string{rcpt}, true
+		}
+		return nil, false
+	}
+	if targets, ok := r.aliases.Expand(base); ok {
+		slog.Info("expanded alias", "alias", base, "detail", sub.detail, "targets", targets)
+		return Map(targets, func(target string) string {
+			return r.subaddress.deliverTo(target, sub)
+		}), true
+	}
+	if r.mailboxes.Match(rcpt) || r.mailboxes.Match(base) {
+		return []string{r.subaddress.deliverTo(base, sub)}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMailboxMatcher(t *testing.T) {
+	patterns := []string{
+		"user@example.com",
+		"*@wildcard.example",
+		"support-?@example.com",
+		`/^(sales|info)@regex\.example$/`,
+	}
+
+	tests := []struct {
+		name                   string
+		address                string
+		caseSensitiveLocalPart bool
+		expected               bool
+	}{
+		{
+			name:     "exact match",
+			address:  "user@example.com",
+			expected: true,
+		},
+		{
+			name:     "exact match ignores case",
+			address:  "User@EXAMPLE.com",
+			expected: true,
+		},
+		{
+			name:                   "case-sensitive local part",
+			address:                "User@example.com",
+			caseSensitiveLocalPart: true,
+			expected:               false,
+		},
+		{
+			name:                   "domain is never case-sensitive",
+			address:                "user@EXAMPLE.COM",
+			caseSensitiveLocalPart: true,
+			expected:               true,
+		},
+		{
+			name:     "no match",
+			address:  "other@example.com",
+			expected: false,
+		},
+		{
+			name:     "domain wildcard",
+			address:  "anyone@Wildcard.Example",
+			expected: true,
+		},
+		{
+			name:     "domain wildcard doesn't match subdomain",
+			address:  "anyone@sub.wildcard.example",
+			expected: false,
+		},
+		{
+			name:     "single character wildcard",
+			address:  "support-1@example.com",
+			expected: true,
+		},
+		{
+			name:     "single character wildcard needs one character",
+			address:  "support-12@example.com",
+			expected: false,
+		},
+		{
+			name:     "regular expression",
+			address:  "Sales@regex.example",
+			expected: true,
+		},
+		{
+			name:     "regular expression is anchored by the pattern",
+			address:  "presales@regex.example",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newMailboxMatcher(patterns, tt.caseSensitiveLocalPart)
+			if err != nil {
+				t.Fatalf("newMailboxMatcher() error = %v", err)
+			}
+			if result := m.Match(tt.address); result != tt.expected {
+				t.Errorf("Match(%q) = %v, want %v", tt.address, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewMailboxMatcherInvalidRegexp(t *testing.T) {
+	if _, err := newMailboxMatcher([]string{"/[a-/"}, false); err == nil {
+		t.Errorf("newMailboxMatcher() error = nil, want an error")
+	}
+}
+
+func TestSplitMailboxPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "addresses",
+			input:    "a@example.com, b@example.com",
+			expected: []string{"a@example.com", "b@example.com"},
+		},
+		{
+			name:     "regular expression with commas",
+			input:    `/^[a-z]{2,3}@example\.com$/,*@example.org`,
+			expected: []string{`/^[a-z]{2,3}@example\.com$/`, "*@example.org"},
+		},
+		{
+			name:     "escaped slash in regular expression",
+			input:    `/^a\/b,c@example\.com$/, d@example.com`,
+			expected: []string{`/^a\/b,c@example\.com$/`, "d@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := splitMailboxPatterns(tt.input); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("splitMailboxPatterns() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRecipientResolver(t *testing.T) {
+	matcher, err := newMailboxMatcher([]string{"a@example.com", "*@example.org"}, false)
+	if err != nil {
+		t.Fatalf("newMailboxMatcher() error = %v", err)
+	}
+	aliases, err := newAliasMap(map[string][]string{
+		"sales@example.com": {"a@example.com", "x@example.net"},
+	}, false)
+	if err != nil {
+		t.Fatalf("newAliasMap() error = %v", err)
+	}
+	resolver := &recipientResolver{
+		mailboxes:  matcher,
+		aliases:    aliases,
+		subaddress: &subaddressConfig{delimiters: "+", mode: subaddressKeep},
+		catchAll: map[string]catchAll{
+			"catchall.example": {targets: []string{"postmaster@catchall.example"}},
+			"drop.example":     {action: catchAllDrop},
+			"reject.example":   {action: catchAllReject},
+		},
+		defaultMailbox: "default@example.com",
+	}
+
+	tests := []struct {
+		name       string
+		recipients []string
+		expected   []string
+		rejected   []string
+	}{
+		{
+			name:       "matching recipients",
+			recipients: []string{"A@example.com", "b@example.com", "c@example.org"},
+			expected:   []string{"A@example.com", "c@example.org"},
+		},
+		{
+			name:       "alias expands to unlisted mailboxes without duplicates",
+			recipients: []string{"a@example.com", "Sales@example.com"},
+			expected:   []string{"a@example.com", "x@example.net"},
+		},
+		{
+			name:       "subaddress matches base mailbox",
+			recipients: []string{"a+newsletters@example.com"},
+			expected:   []string{"a+newsletters@example.com"},
+		},
+		{
+			name:       "subaddress of an alias",
+			recipients: []string{"sales+leads@example.com"},
+			expected:   []string{"a+leads@example.com", "x+leads@example.net"},
+		},
+		{
+			name:       "subaddress of an unknown mailbox",
+			recipients: []string{"b+newsletters@example.com"},
+			expected:   []string{"default@example.com"},
+		},
+		{
+			name:       "no matching recipients",
+			recipients: []string{"b@example.com"},
+			expected:   []string{"default@example.com"},
+		},
+		{
+			name:       "domain catch-all",
+			recipients: []string{"unknown@CatchAll.example", "a@example.com"},
+			expected:   []string{"postmaster@catchall.example", "a@example.com"},
+		},
+		{
+			name:       "dropped recipient",
+			recipients: []string{"unknown@drop.example"},
+			expected:   nil,
+		},
+		{
+			name:       "dropped recipient with another unknown recipient",
+			recipients: []string{"unknown@drop.example", "b@example.com"},
+			expected:   []string{"default@example.com"},
+		},
+		{
+			name:       "rejected recipient",
+			recipients: []string{"unknown@reject.example", "a@example.com"},
+			expected:   []string{"a@example.com"},
+			rejected:   []string{"unknown@reject.example"},
+		},
+		{
+			name:       "only rejected recipients",
+			recipients: []string{"unknown@reject.example"},
+			expected:   nil,
+			rejected:   []string{"unknown@reject.example"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, rejected := resolver.Resolve(tt.recipients)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Resolve() = %v, want %v", result, tt.expected)
+			}
+			if len(rejected) != len(tt.rejected) {
+				t.Fatalf("Resolve() rejected = %v, want %v", rejected, tt.rejected)
+			}
+			for _, rcpt := range tt.rejected {
+				if err := rejected[rcpt]; !errors.Is(err, errRejected) || isRetryable(err) {
+					t.Errorf("Resolve() rejected[%q] = %v, want a permanent %v", rcpt, err, errRejected)
+				}
+			}
+		})
+	}
+}
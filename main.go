@@ -4,26 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"net/http"
 	"net/mail"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
-	smtp "github.com/emersion/go-smtp"
 	_ "github.com/joho/godotenv/autoload"
 )
 
@@ -39,34 +36,43 @@ var (
 )
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve polls the configured queues and delivers their messages until it
+// receives SIGINT or SIGTERM.
+func serve(args []string, stderr io.Writer) int {
+	flags := newFlagSet("run", stderr)
+	configPath := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
 	// Log build information
 	slog.Info("build information", "version", version, "commit", commit, "buildDate", buildDate)
 
-	sqsQueueURL := MustGetEnv("SQS_QUEUE_URL", nil)
-	lmtpHost := MustGetEnv("LMTP_HOST", nil)
-	lmtpFrom := MustGetEnv("LMTP_FROM", nil)
-	healthCheckPort := MustGetEnv("HEALTH_CHECK_PORT", aws.String("8080"))
-	mailboxes := Map(strings.Split(MustGetEnv("MAILBOXES", nil), ","), func(v string) string {
-		return strings.TrimSpace(v)
-	})
-	defaultMailbox := MustGetEnv("DEFAULT_MAILBOX", nil)
-
-	slog.Info("starting up", "config", map[string]string{
-		"mailboxes":       strings.Join(mailboxes, ","),
-		"defaultMailbox":  defaultMailbox,
-		"lmtpHost":        lmtpHost,
-		"lmtpFrom":        lmtpFrom,
-		"sqsQueueURL":     sqsQueueURL,
-		"healthCheckPort": healthCheckPort,
-	})
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+	resolver, err := newRecipientResolver(cfg.Recipients)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+
+	slog.Info("starting up", "config", cfg.Summary(), "aliases", resolver.aliases.Len())
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Set up signal handling for graceful shutdown
+	// Set up signal handling for graceful shutdown and reloads
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	// Start goroutine to handle shutdown signals
 	go func() {
@@ -76,21 +82,86 @@ func main() {
 	}()
 
 	// Initialize AWS config
-	cfg, err := config.LoadDefaultConfig(ctx)
-	Check(err, "failed to load AWS config")
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("failed to load aws config", "err", err)
+		return 1
+	}
 
 	// Create AWS service clients
-	sqsClient := sqs.NewFromConfig(cfg)
-	s3Client := s3.NewFromConfig(cfg)
-	lmtpSender := newLMTPSender(lmtpHost, lmtpFrom)
+	sqsClient := sqs.NewFromConfig(awsConfig)
+	s3Client := s3.NewFromConfig(awsConfig)
+	// A dry run logs where messages would be delivered without connecting
+	// to the mail servers
+	deliver := newDeliverer
+	if cfg.DryRun.Enabled {
+		slog.Warn("dry run, messages are processed but neither delivered nor deleted", "resetVisibility", cfg.DryRun.ResetVisibility)
+		deliver = newDryRunDeliverer
+	}
+	deliverer, err := deliver(cfg.Delivery)
+	if err != nil {
+		slog.Error("failed to configure delivery", "err", err)
+		return 1
+	}
+	ledger := newDeliveryLedger(14 * 24 * time.Hour) // The maximum SQS message retention period
 
-	processMessage := newMessageProcessor(mailboxes, defaultMailbox, s3Client, lmtpSender)
+	// Mailboxes and routing are reloaded on SIGHUP, and when the config or
+	// alias file changes if CONFIG_WATCH_INTERVAL is set
+	live := newLiveConfig(*configPath, os.LookupEnv, cfg, resolver, deliverer)
+	live.newDeliverer = deliver
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupChan:
+				live.reload("SIGHUP")
+			}
+		}
+	}()
+	if cfg.WatchInterval > 0 {
+		go live.watch(ctx, cfg.WatchInterval)
+	}
+
+	// With a backfill bucket, processed emails are recorded so that the
+	// scanner only delivers the ones SQS never brought
+	pipeline := &emailPipeline{
+		live:     live,
+		s3Client: s3Client,
+		ledger:   ledger,
+		dryRun:   cfg.DryRun.Enabled,
+		verifier: newSNSVerifier(cfg.SNS.SignatureVerification, cfg.SNS.TopicArns),
+		// A message in backoff is hidden for up to the longest retry delay,
+		// and its next receive may take up to a visibility timeout to fail
+		retryLease: cfg.Retry.MaxDelay + cfg.VisibilityTimeout,
+	}
+	if cfg.Backfill.Bucket != "" {
+		pipeline.markers, err = openMarkerFile(cfg.Backfill.MarkerFile)
+		if err != nil {
+			slog.Error("failed to configure backfill", "err", err)
+			return 1
+		}
+		defer pipeline.markers.Close()
+		slog.Info("recording processed emails", "markerFile", cfg.Backfill.MarkerFile, "processed", pipeline.markers.Len())
+	}
+
+	processMessage := newMessageProcessor(pipeline)
+	handleMessage := newMessageHandler(sqsClient, &failureHandler{
+		sqsClient:          sqsClient,
+		policy:             cfg.Retry.PermanentFailurePolicy,
+		deadLetterQueueURL: cfg.Retry.DeadLetterQueueURL,
+		baseDelay:          cfg.Retry.BaseDelay,
+		maxDelay:           cfg.Retry.MaxDelay,
+	}, processMessage)
+	if cfg.DryRun.Enabled {
+		handleMessage = newDryRunHandler(sqsClient, cfg.DryRun.ResetVisibility, processMessage)
+	}
 
 	// Start HTTP server
 	httpServer := &http.Server{
-		Addr: ":" + healthCheckPort,
+		Addr: ":" + cfg.HealthCheckPort,
 	}
-	http.HandleFunc("/stats.json", statsHandler)
+	http.HandleFunc("/stats.json", newStatsHandler(live))
 
 	go func() {
 		slog.Info("starting http server", "addr", httpServer.Addr)
@@ -99,174 +170,438 @@ func main() {
 		}
 	}()
 
+	// Start workers. Their contexts are independent of ctx so that a shutdown
+	// signal stops polling but lets in-flight deliveries finish.
+	pool := newWorkerPool(cfg.WorkerCount, handleMessage)
+
 	slog.Info("starting ses to lmtp forwarder")
+	var polling sync.WaitGroup
+	for _, queue := range cfg.Queues {
+		polling.Add(1)
+		go func() {
+			defer polling.Done()
+			pollMessages(ctx, sqsClient, queue.URL, min(cfg.WorkerCount, 10), cfg.VisibilityTimeout, pool)
+		}()
+	}
+	if cfg.Backfill.Interval > 0 {
+		b := &backfiller{pipeline: pipeline, client: s3Client, cfg: cfg.Backfill, now: time.Now}
+		polling.Add(1)
+		go func() {
+			defer polling.Done()
+			b.run(ctx, cfg.Backfill.Interval)
+		}()
+	}
+	polling.Wait()
+
+	slog.Info("shutting down gracefully...", "timeout", cfg.ShutdownTimeout)
+	if !pool.Drain(cfg.ShutdownTimeout) {
+		slog.Warn("timed out waiting for in-flight messages, cancelled remaining deliveries")
+	}
+	slog.Info("drained in-flight messages")
+
+	if err := live.Close(); err != nil {
+		slog.Error("failed to close deliverer", "err", err)
+	}
+
+	if err := httpServer.Shutdown(context.Background()); err != nil {
+		slog.Error("failed to shutdown http server", "err", err)
+	}
+	return 0
+}
+
+// queuedMessage is a message and the queue it was received from.
+type queuedMessage struct {
+	queueURL string
+	message  sqsTypes.Message
+	// stopHeartbeat stops extending the visibility timeout of the message,
+	// which starts as soon as it is received. It may be nil.
+	stopHeartbeat func()
+}
 
-	// Main processing loop
+// pollMessages receives messages from the queue and submits them to the pool
+// until ctx is cancelled. A batch may have to wait for workers to become free,
+// so the visibility timeout of every message is extended from the moment it
+// is received rather than when a worker picks it up.
+func pollMessages(ctx context.Context, sqsClient *sqs.Client, queueURL string, batchSize int, visibilityTimeout time.Duration, pool *workerPool[queuedMessage]) {
 	for {
-		select {
-		case <-ctx.Done():
-			slog.Info("shutting down gracefully...")
-			if err := httpServer.Shutdown(context.Background()); err != nil {
-				slog.Error("failed to shutdown http server", "err", err)
-			}
+		if ctx.Err() != nil {
+			slog.Info("context cancelled, stopping message polling", "queueURL", queueURL)
 			return
-		default:
-			slog.Info("polling messages from sqs")
-			result, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-				QueueUrl:            aws.String(sqsQueueURL),
-				MaxNumberOfMessages: 10,
-				WaitTimeSeconds:     20, // Long polling
-			})
-			if err != nil {
-				if ctx.Err() != nil {
-					slog.Info("context cancelled, stopping message processing")
-					return
-				}
-				slog.Error("failed to receive messages from sqs", "err", err)
-				errCountLock.Lock()
-				errCount++
-				errCountLock.Unlock()
-				time.Sleep(time.Second)
-				continue
+		}
+
+		slog.Info("polling messages from sqs", "queueURL", queueURL)
+		result, err := sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: int32(batchSize),
+			VisibilityTimeout:   int32(visibilityTimeout.Seconds()),
+			WaitTimeSeconds:     20, // Long polling
+			AttributeNames: []sqsTypes.QueueAttributeName{
+				sqsTypes.QueueAttributeName(sqsTypes.MessageSystemAttributeNameApproximateReceiveCount),
+			},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("context cancelled, stopping message polling", "queueURL", queueURL)
+				return
 			}
-			slog.Info("polled messages from sqs", "count", len(result.Messages))
+			slog.Error("failed to receive messages from sqs", "queueURL", queueURL, "err", err)
 			errCountLock.Lock()
-			errCount = 0
+			errCount++
 			errCountLock.Unlock()
-
-			// Process each message
-			for _, message := range result.Messages {
-				// Check context before processing each message
-				if ctx.Err() != nil {
-					slog.Info("context cancelled, stopping message processing")
-					return
-				}
-
-				slog.Info("processing message")
-				if err := processMessage(ctx, message); err != nil {
-					slog.Error("failed to process message", "err", err)
-					continue
-				}
-				slog.Info("processed message")
-
-				slog.Info("deleting message")
-				_, err = sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
-					QueueUrl:      aws.String(sqsQueueURL),
-					ReceiptHandle: message.ReceiptHandle,
-				})
-				if err != nil {
-					slog.Info("failed to delete message from queue", "err", err)
-					continue
+			time.Sleep(time.Second)
+			continue
+		}
+		slog.Info("polled messages from sqs", "queueURL", queueURL, "count", len(result.Messages))
+		errCountLock.Lock()
+		errCount = 0
+		errCountLock.Unlock()
+
+		jobs := make([]queuedMessage, len(result.Messages))
+		for i, message := range result.Messages {
+			// The heartbeat outlives ctx, which only stops polling, and is
+			// stopped by the handler once the message has been processed
+			stop := startHeartbeat(context.WithoutCancel(ctx), sqsClient, queueURL, message.ReceiptHandle, visibilityTimeout)
+			jobs[i] = queuedMessage{queueURL: queueURL, message: message, stopHeartbeat: stop}
+		}
+		for i, job := range jobs {
+			if err := pool.Submit(ctx, job); err != nil {
+				slog.Info("context cancelled, leaving remaining messages on the queue", "queueURL", queueURL, "count", len(jobs)-i)
+				for _, job := range jobs[i:] {
+					job.stopHeartbeat()
 				}
-				slog.Info("deleted message")
+				return
 			}
 		}
 	}
 }
 
-func newMessageProcessor(
-	mailboxes []string,
-	defaultMailbox string,
-	s3Client *s3.Client,
-	emailSender func(to []string, body io.Reader) error,
-) func(ctx context.Context, message sqsTypes.Message) error {
+// newMessageHandler returns a worker handler that processes a message and
+// deletes it from its queue once it has been delivered. The message's
+// heartbeat is stopped once processing is done, and failures are passed to
+// onFailure.
+func newMessageHandler(
+	sqsClient *sqs.Client,
+	onFailure *failureHandler,
+	processMessage func(ctx context.Context, message sqsTypes.Message) error,
+) func(ctx context.Context, job queuedMessage) {
+	return func(ctx context.Context, job queuedMessage) {
+		message := job.message
+		logger := slog.With("messageId", Value(message.MessageId), "queueURL", job.queueURL)
+
+		logger.Info("processing message")
+		err := processMessage(ctx, message)
+		if job.stopHeartbeat != nil {
+			job.stopHeartbeat()
+		}
+		if err != nil {
+			onFailure.handle(ctx, logger, job.queueURL, message, err)
+			return
+		}
+		logger.Info("processed message")
+
+		logger.Info("deleting message")
+		_, err = sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(job.queueURL),
+			ReceiptHandle: message.ReceiptHandle,
+		})
+		if err != nil {
+			logger.Info("failed to delete message from queue", "err", err)
+			return
+		}
+		logger.Info("deleted message")
+	}
+}
+
+// s3ObjectAPI is the subset of the S3 client used to fetch stored emails.
+type s3ObjectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// emailPipeline fetches emails from S3 and delivers them to their resolved
+// recipients. It is shared by the SQS consumer and the replay command.
+type emailPipeline struct {
+	live     *liveConfig
+	s3Client s3ObjectAPI
+	ledger   *deliveryLedger
+	// dryRun hands every resolved recipient to the deliverer and leaves the
+	// ledger untouched.
+	dryRun bool
+	// markers records the emails that have been processed for the backfill
+	// scanner. It may be nil.
+	markers *markerFile
+	// retryLease is how long an SQS message that failed transiently may take
+	// to be received again: the longest retry delay plus the visibility
+	// timeout. The email is leased to the message for that long.
+	retryLease time.Duration
+	// verifier checks the signatures of SNS notifications. It is nil if they
+	// aren't verified.
+	verifier *snsVerifier
+}
+
+// newMessageProcessor returns a function that delivers the email an SES
+// notification refers to. Each message is processed with the configuration
+// that was current when it started, even if live is reloaded meanwhile.
+func newMessageProcessor(p *emailPipeline) func(ctx context.Context, message sqsTypes.Message) error {
 	return func(ctx context.Context, message sqsTypes.Message) error {
 		// Check if context is cancelled before processing
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		current, release := p.live.Acquire()
+		defer release()
 
-		slog.Info("parsing message as sns entity", "message", message)
-		var snsEntity events.SNSEntity
-		if err := json.Unmarshal([]byte(Value(message.Body)), &snsEntity); err != nil {
-			return fmt.Errorf("failed to unmarshal sns entity: %w", err)
+		payload, err := parsePayload(ctx, message, p.verifier)
+		if err != nil {
+			return err
 		}
-		slog.Info("parsed message", "entity", snsEntity)
-
-		slog.Info("parsing entity message as ses event")
-		var sesEvent events.SimpleEmailService
-		if err := json.Unmarshal([]byte(snsEntity.Message), &sesEvent); err != nil {
-			return fmt.Errorf("failed to unmarshal ses entity: %w", err)
+		if payload.notification == nil {
+			return p.deliverObjects(ctx, payload.objects)
 		}
-		slog.Info("parsed entity message as ses event", "sesEvent", sesEvent)
-
-		if at := sesEvent.Receipt.Action.Type; at != "S3" {
+		notification := payload.notification
+		sesEvent := notification.SimpleEmailService
+
+		// The S3 action stores the email in a bucket, while the SNS action
+		// publishes it in the notification itself
+		var emailBody []byte
+		bucket, key := sesEvent.Receipt.Action.BucketName, sesEvent.Receipt.Action.ObjectKey
+		switch at := sesEvent.Receipt.Action.Type; at {
+		case sesActionS3:
+			if p.alreadyProcessed(bucket, key) {
+				return nil
+			}
+			emailBody, err = p.fetch(ctx, bucket, key)
+			if err != nil {
+				p.markQueued(bucket, key, err)
+				return err
+			}
+		case sesActionSNS:
+			emailBody, err = notification.email()
+			if err != nil {
+				return err
+			}
+		default:
 			slog.Error("unsupported action type", "type", at)
 			return nil
 		}
 
-		slog.Info("getting mail body from s3")
-		goOut, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: aws.String(sesEvent.Receipt.Action.BucketName),
-			Key:    aws.String(sesEvent.Receipt.Action.ObjectKey),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to get object from s3: %w", err)
+		slog.Info("got recipients from ses event", "recipients", sesEvent.Receipt.Recipients)
+
+		slog.Info("filtering recipients")
+		recipients, rejected := current.resolver.Resolve(sesEvent.Receipt.Recipients)
+		slog.Info("filtered recipients", "recipients", recipients, "rejected", len(rejected))
+
+		ledgerKey := sesEvent.Mail.MessageID
+		if ledgerKey == "" {
+			ledgerKey = Value(message.MessageId)
 		}
-		defer func() {
-			if err := goOut.Body.Close(); err != nil {
-				slog.Warn("failed to close S3 object body", "err", err)
-			}
-		}()
-		slog.Info("got mail body from s3", "data", goOut)
+		envelope := Envelope{
+			From:       sesEvent.Mail.Source,
+			Recipients: recipients,
+			Mail:       sesEvent.Mail,
+			Receipt:    sesEvent.Receipt,
+		}
+		err = p.deliver(ctx, current.deliverer, ledgerKey, envelope, rejected, emailBody)
+		if sesEvent.Receipt.Action.Type == sesActionS3 {
+			p.markQueued(bucket, key, err)
+		}
+		return err
+	}
+}
 
-		slog.Info("reading s3 object body")
-		emailBody, err := io.ReadAll(goOut.Body)
-		if err != nil {
-			return fmt.Errorf("failed to get s3 object body: %w", err)
+// fetch reads the email stored at key in bucket and checks that it parses as
+// a message.
+func (p *emailPipeline) fetch(ctx context.Context, bucket, key string) ([]byte, error) {
+	slog.Info("getting mail body from s3", "bucket", bucket, "key", key)
+	goOut, err := p.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object from s3: %w", err)
+	}
+	defer func() {
+		if err := goOut.Body.Close(); err != nil {
+			slog.Warn("failed to close S3 object body", "err", err)
 		}
-		slog.Info("read s3 object body", "bodyLength", len(emailBody))
+	}()
+	slog.Info("got mail body from s3", "data", goOut)
+
+	slog.Info("reading s3 object body")
+	emailBody, err := io.ReadAll(goOut.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get s3 object body: %w", err)
+	}
+	slog.Info("read s3 object body", "bodyLength", len(emailBody))
 
-		slog.Info("parsing email body")
-		emailMsg, err := mail.ReadMessage(bytes.NewBuffer(emailBody))
+	if err := parseEmail(emailBody); err != nil {
+		return nil, err
+	}
+	return emailBody, nil
+}
+
+// parseEmail checks that emailBody parses as a message.
+func parseEmail(emailBody []byte) error {
+	slog.Info("parsing email body")
+	emailMsg, err := mail.ReadMessage(bytes.NewBuffer(emailBody))
+	if err != nil {
+		return permanent(fmt.Errorf("failed to read email: %w", err))
+	}
+	slog.Info("parsed email", "email", emailMsg)
+	return nil
+}
+
+// deliverObjects delivers emails stored in S3 that S3 event notifications
+// announced. Without SES metadata their recipients are taken from their
+// headers. Each email is attempted even if another fails; if any may succeed
+// on a retry, the whole message is retried.
+func (p *emailPipeline) deliverObjects(ctx context.Context, objects []storedEmail) error {
+	var errs []error
+	for _, object := range objects {
+		if p.alreadyProcessed(object.bucket, object.key) {
+			continue
+		}
+		recipients, err := p.deliverStored(ctx, object.bucket, object.key, nil)
+		p.markQueued(object.bucket, object.key, err)
 		if err != nil {
-			return fmt.Errorf("failed to read email: %v", err)
+			errs = append(errs, fmt.Errorf("failed to deliver s3://%s/%s: %w", object.bucket, object.key, err))
+			continue
 		}
-		slog.Info("parsed email", "email", emailMsg)
+		slog.Info("delivered stored email", "bucket", object.bucket, "key", object.key, "recipients", recipients)
+	}
+	for _, err := range errs {
+		if isRetryable(err) {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		slog.Info("got recipients from ses event", "recipients", sesEvent.Receipt.Recipients)
+// markProcessed records that the email at key in bucket was processed with
+// the outcome err, unless it can still be delivered on a retry. Only emails
+// every deliverable recipient has are marked as delivered; permanent failures
+// are recorded separately. Nothing is recorded in a dry run.
+func (p *emailPipeline) markProcessed(bucket, key string, err error) {
+	if p.markers == nil || p.dryRun || (err != nil && isRetryable(err)) {
+		return
+	}
+	var deliveredErr *deliveredError
+	if err != nil && !errors.As(err, &deliveredErr) {
+		if err := p.markers.Fail(bucket, key); err != nil {
+			slog.Error("failed to mark email as failed", "bucket", bucket, "key", key, "err", err)
+		}
+		return
+	}
+	if err := p.markers.Mark(bucket, key); err != nil {
+		slog.Error("failed to mark email as processed", "bucket", bucket, "key", key, "err", err)
+	}
+}
 
-		slog.Info("filtering recipients")
-		recipients := Filter(sesEvent.Receipt.Recipients, func(r string) bool {
-			return Contains(mailboxes, r)
-		})
-		if len(recipients) == 0 {
-			slog.Info("no valid recipients found, using default mailbox", "defaultMailbox", defaultMailbox)
-			recipients = []string{defaultMailbox}
+// markQueued records the outcome of processing the email at key in bucket for
+// an SQS message. It is like markProcessed, except that after a retryable
+// failure the email is leased to the message until it is due to be retried,
+// so that the backfill scanner doesn't deliver it as well.
+func (p *emailPipeline) markQueued(bucket, key string, err error) {
+	if p.markers == nil || p.dryRun {
+		return
+	}
+	if err == nil || !isRetryable(err) {
+		p.markProcessed(bucket, key, err)
+		return
+	}
+	if err := p.markers.Lease(bucket, key, time.Now().Add(p.retryLease)); err != nil {
+		slog.Error("failed to lease email to sqs message", "bucket", bucket, "key", key, "err", err)
+	}
+}
+
+// alreadyProcessed reports whether the email at key in bucket has been
+// delivered already, such as by the backfill scanner while the SQS message
+// for it was waiting. Emails that failed permanently are processed again.
+func (p *emailPipeline) alreadyProcessed(bucket, key string) bool {
+	if p.markers == nil || !p.markers.Has(bucket, key) {
+		return false
+	}
+	slog.Info("email was already processed, skipping", "bucket", bucket, "key", key)
+	return true
+}
+
+// deliver delivers emailBody to the recipients of envelope, which have
+// already been resolved to mailboxes, with deliverer. rejected are the
+// recipients that resolving rejected; they are reported once the others have
+// the email, marked as delivered. Recipients that accepted the email on a
+// previous attempt, as recorded in the ledger under ledgerKey, are skipped.
+func (p *emailPipeline) deliver(ctx context.Context, deliverer Deliverer, ledgerKey string, envelope Envelope, rejected recipientErrors, emailBody []byte) error {
+	recipients := envelope.Recipients
+	if len(recipients) == 0 {
+		if len(rejected) > 0 {
+			return rejectedError(rejected)
 		}
-		slog.Info("filtered recipients", "recipients", recipients)
+		slog.Info("every recipient was dropped by a catch-all")
+		return nil
+	}
 
-		slog.Info("sending email")
-		if err := emailSender(recipients, bytes.NewBuffer(emailBody)); err != nil {
+	if p.dryRun {
+		if err := deliverer.Deliver(ctx, envelope, bytes.NewBuffer(emailBody)); err != nil {
 			return fmt.Errorf("failed to send email: %w", err)
 		}
-		slog.Info("sent email")
-		return nil
+		return delivered(rejectedError(rejected))
 	}
-}
 
-func newLMTPSender(host, from string) func(to []string, body io.Reader) error {
-	return func(to []string, body io.Reader) error {
-		conn, err := net.Dial("tcp", host)
-		Check(err, "failed to dial")
+	// Skip recipients that accepted the message on a previous attempt
+	pending := p.ledger.Pending(ledgerKey, recipients)
+	if len(pending) == 0 {
+		slog.Info("all recipients already accepted the email on a previous attempt")
+		if len(rejected) == 0 {
+			p.ledger.Forget(ledgerKey)
+		}
+		return delivered(rejectedError(rejected))
+	}
+	if len(pending) < len(recipients) {
+		slog.Info("retrying delivery to remaining recipients", "recipients", pending)
+	}
 
-		lmtpClient := smtp.NewClientLMTP(conn)
-		defer func() {
-			_ = lmtpClient.Quit()
-			_ = conn.Close()
-		}()
-		return lmtpClient.SendMail(from, to, body)
+	slog.Info("sending email")
+	envelope.Recipients = pending
+	if err := deliverer.Deliver(ctx, envelope, bytes.NewBuffer(emailBody)); err != nil {
+		var rcptErrs recipientErrors
+		if errors.As(err, &rcptErrs) {
+			delivered := Filter(pending, func(r string) bool {
+				_, failed := rcptErrs[r]
+				return !failed
+			})
+			p.ledger.Record(ledgerKey, delivered)
+			slog.Warn("email was only delivered to some recipients", "delivered", delivered, "failed", len(rcptErrs))
+			return fmt.Errorf("failed to send email to %d of %d recipients: %w", len(rcptErrs), len(pending), err)
+		}
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	slog.Info("sent email")
+	if len(rejected) > 0 {
+		// Remember who already has it in case the message comes back
+		// before the failure policy removes it
+		p.ledger.Record(ledgerKey, pending)
+		return delivered(rejectedError(rejected))
 	}
+	p.ledger.Forget(ledgerKey)
+	return nil
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	errCountLock.RLock()
-	errCount := errCount
-	errCountLock.RUnlock()
+// newStatsHandler returns the /stats.json handler. Deliverers with multiple
+// backends also report the state of each backend.
+func newStatsHandler(backends backendReporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		errCountLock.RLock()
+		errCount := errCount
+		errCountLock.RUnlock()
+
+		stats := map[string]any{
+			"healthy":    errCount < 3,
+			"errorCount": errCount,
+		}
+		if backendStats := backends.Stats(); backendStats != nil {
+			stats["backends"] = backendStats
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{
-		"healthy":    errCount < 3,
-		"errorCount": errCount,
-	})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// SES receipt rule actions that deliver the email
+	sesActionS3  = "S3"
+	sesActionSNS = "SNS"
+
+	// Encodings of the email content published by the SNS action
+	sesEncodingUTF8   = "UTF8"
+	sesEncodingBase64 = "BASE64"
+)
+
+// sesNotification is the notification SES publishes for a received email. It
+// adds the fields of the SNS action that events.SimpleEmailService leaves out.
+type sesNotification struct {
+	events.SimpleEmailService
+	// Content is the email itself when the SNS action delivered it, encoded
+	// as Encoding says.
+	Content  string `json:"content"`
+	Encoding string `json:"-"`
+}
+
+func (n *sesNotification) UnmarshalJSON(data []byte) error {
+	// The encoding is part of the receipt action, whose type doesn't have it
+	var action struct {
+		Receipt struct {
+			Action struct {
+				Encoding string `json:"encoding"`
+			} `json:"action"`
+		} `json:"receipt"`
+	}
+	if err := json.Unmarshal(data, &action); err != nil {
+		return err
+	}
+	type fields sesNotification
+	if err := json.Unmarshal(data, (*fields)(n)); err != nil {
+		return err
+	}
+	n.Encoding = action.Receipt.Action.Encoding
+	return nil
+}
+
+// email decodes the email the SNS action published in the notification.
+func (n *sesNotification) email() ([]byte, error) {
+	if n.Content == "" {
+		return nil, permanent(fmt.Errorf("sns action notification has no content"))
+	}
+
+	var emailBody []byte
+	switch n.Encoding {
+	case sesEncodingUTF8, "":
+		emailBody = []byte(n.Content)
+	case sesEncodingBase64:
+		var err error
+		emailBody, err = base64.StdEncoding.DecodeString(n.Content)
+		if err != nil {
+			return nil, permanent(fmt.Errorf("failed to decode sns action content: %w", err))
+		}
+	default:
+		return nil, permanent(fmt.Errorf("unknown sns action encoding %q", n.Encoding))
+	}
+	slog.Info("decoded email from notification", "encoding", n.Encoding, "bodyLength", len(emailBody))
+
+	if err := parseEmail(emailBody); err != nil {
+		return nil, err
+	}
+	return emailBody, nil
+}
+
+// Types of SNS messages
+const (
+	snsTypeNotification             = "Notification"
+	snsTypeSubscriptionConfirmation = "SubscriptionConfirmation"
+)
+
+// Shapes of SQS message bodies
+const (
+	payloadSNS         = "sns"
+	payloadSES         = "ses"
+	payloadS3Event     = "s3"
+	payloadEventBridge = "eventbridge"
+	payloadS3TestEvent = "s3-test"
+)
+
+// storedEmail is an email stored in S3.
+type storedEmail struct {
+	bucket, key string
+}
+
+// inboundPayload is what an SQS message asks to be delivered: an SES
+// notification, or emails stored in S3 that S3 event notifications announced
+// without any SES metadata.
+type inboundPayload struct {
+	notification *sesNotification
+	objects      []storedEmail
+}
+
+// parsePayload works out the shape of the body of message and parses it. SES
+// notifications and S3 event notifications are understood, either on their
+// own or wrapped in an SNS notification, and so are S3 events sent through
+// EventBridge. They arrive on their own when the SNS subscription has raw
+// message delivery turned on. If verifier isn't nil, SNS notifications must be
+// signed by SNS.
+func parsePayload(ctx context.Context, message sqsTypes.Message, verifier *snsVerifier) (*inboundPayload, error) {
+	slog.Info("parsing message payload", "messageId", Value(message.MessageId))
+	return parsePayloadBody(ctx, []byte(Value(message.Body)), verifier, true)
+}
+
+func parsePayloadBody(ctx context.Context, body []byte, verifier *snsVerifier, unwrapSNS bool) (*inboundPayload, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		if !unwrapSNS {
+			return nil, permanent(fmt.Errorf("sns notification message is not json: %w", err))
+		}
+		return nil, permanent(fmt.Errorf("failed to unmarshal message payload: %w", err))
+	}
+	shape := payloadShape(fields)
+	slog.Info("detected message payload", "shape", shape)
+	if unwrapSNS && shape != payloadSNS && verifier != nil && verifier.requireSigned {
+		return nil, permanent(fmt.Errorf("%s message payload isn't wrapped in a signed sns notification", cmp.Or(shape, "unrecognized")))
+	}
+
+	switch {
+	case shape == payloadSNS && unwrapSNS:
+		var snsEntity events.SNSEntity
+		if err := json.Unmarshal(body, &snsEntity); err != nil {
+			return nil, permanent(fmt.Errorf("failed to unmarshal sns entity: %w", err))
+		}
+		slog.Info("parsed message", "messageId", snsEntity.MessageID, "topicArn", snsEntity.TopicArn, "type", snsEntity.Type)
+		switch {
+		case snsEntity.Type == snsTypeSubscriptionConfirmation:
+			return nil, permanent(fmt.Errorf("sns subscription to %s needs confirming, confirm it in the sns console", snsEntity.TopicArn))
+		case snsEntity.Type != snsTypeNotification:
+			return nil, permanent(fmt.Errorf("unexpected sns message type %q", snsEntity.Type))
+		case snsEntity.Message == "":
+			return nil, permanent(fmt.Errorf("sns notification has no message"))
+		}
+		if verifier != nil {
+			if err := verifier.Verify(ctx, body); err != nil {
+				return nil, err
+			}
+			slog.Info("verified sns signature", "messageId", snsEntity.MessageID)
+		}
+		return parsePayloadBody(ctx, []byte(snsEntity.Message), nil, false)
+	case shape == payloadSNS:
+		return nil, permanent(fmt.Errorf("sns notification wraps another sns notification"))
+	case shape == payloadSES:
+		var notification sesNotification
+		if err := json.Unmarshal(body, &notification); err != nil {
+			return nil, permanent(fmt.Errorf("failed to unmarshal ses entity: %w", err))
+		}
+		slog.Info("parsed entity message as ses event", "sesEvent", notification.SimpleEmailService)
+		return &inboundPayload{notification: &notification}, nil
+	case shape == payloadS3Event:
+		var s3Event events.S3Event
+		if err := json.Unmarshal(body, &s3Event); err != nil {
+			return nil, permanent(fmt.Errorf("failed to unmarshal s3 event: %w", err))
+		}
+		payload := &inboundPayload{}
+		for _, record := range s3Event.Records {
+			if record.EventSource != "aws:s3" || !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+				slog.Info("ignoring s3 event", "eventSource", record.EventSource, "eventName", record.EventName)
+				continue
+			}
+			payload.addObject(record.S3.Bucket.Name, record.S3.Object.URLDecodedKey)
+		}
+		return payload, nil
+	case shape == payloadEventBridge:
+		var event events.EventBridgeEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, permanent(fmt.Errorf("failed to unmarshal eventbridge event: %w", err))
+		}
+		payload := &inboundPayload{}
+		if event.DetailType != "Object Created" {
+			slog.Info("ignoring eventbridge event", "detailType", event.DetailType)
+			return payload, nil
+		}
+		var detail struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		}
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			return nil, permanent(fmt.Errorf("failed to unmarshal eventbridge event detail: %w", err))
+		}
+		payload.addObject(detail.Bucket.Name, detail.Object.Key)
+		return payload, nil
+	case shape == payloadS3TestEvent:
+		// S3 sends this once when notifications are set up
+		slog.Info("ignoring s3 test event")
+		return &inboundPayload{}, nil
+	default:
+		return nil, permanent(fmt.Errorf("unrecognized message payload with fields %v, want an sns, ses or s3 notification", slices.Sorted(maps.Keys(fields))))
+	}
+}
+
+// payloadShape identifies a message body by its top-level fields. It returns
+// an empty string for bodies it doesn't recognize.
+func payloadShape(fields map[string]json.RawMessage) string {
+	has := func(name string) bool {
+		_, ok := fields[name]
+		return ok
+	}
+	is := func(name, value string) bool {
+		var s string
+		return json.Unmarshal(fields[name], &s) == nil && s == value
+	}
+
+	switch {
+	case has("Type") && has("TopicArn"):
+		return payloadSNS
+	case has("mail") && has("receipt"):
+		return payloadSES
+	case has("Records"):
+		return payloadS3Event
+	case is("source", "aws.s3") && has("detail"):
+		return payloadEventBridge
+	case is("Event", "s3:TestEvent"):
+		return payloadS3TestEvent
+	default:
+		return ""
+	}
+}
+
+// addObject adds the email at key in bucket, unless it is the notice SES
+// stores when a receipt rule is set up.
+func (p *inboundPayload) addObject(bucket, key string) {
+	if path.Base(key) == sesSetupNotificationKey {
+		slog.Info("ignoring ses setup notification", "bucket", bucket, "key", key)
+		return
+	}
+	p.objects = append(p.objects, storedEmail{bucket: bucket, key: key})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const testEmail = "From: sender@example.net\r\nTo: user@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+
+// snsMessage wraps an SES notification in an SNS envelope as SQS receives it.
+func snsMessage(t *testing.T, notification string) sqsTypes.Message {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{
+		"Type":      "Notification",
+		"MessageId": "sns-1",
+		"TopicArn":  "arn:aws:sns:us-east-1:123456789012:ses-inbound",
+		"Message":   notification,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal sns envelope: %v", err)
+	}
+	return sqsTypes.Message{MessageId: aws.String("sqs-1"), Body: aws.String(string(body))}
+}
+
+// sesActionNotification returns an SES notification for user@example.com with
+// the given receipt action and content.
+func sesActionNotification(action, content string) string {
+	return `{
+  "notificationType": "Received",
+  "mail": {"source": "sender@example.net", "messageId": "ses-1", "destination": ["user@example.com"]},
+  "receipt": {"recipients": ["user@example.com"], "action": ` + action + `},
+  "content": ` + content + `
+}`
+}
+
+func TestSESNotificationEmail(t *testing.T) {
+	encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte(testEmail)))
+	plain, _ := json.Marshal(testEmail)
+
+	tests := []struct {
+		name         string
+		notification string
+		expected     string
+		expectErr    bool
+	}{
+		{
+			name:         "utf8",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "UTF8"}`, string(plain)),
+			expected:     testEmail,
+		},
+		{
+			name:         "base64",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "BASE64"}`, string(encoded)),
+			expected:     testEmail,
+		},
+		{
+			name:         "invalid base64",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "BASE64"}`, `"not base64!"`),
+			expectErr:    true,
+		},
+		{
+			name:         "unknown encoding",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "UTF16"}`, string(plain)),
+			expectErr:    true,
+		},
+		{
+			name:         "no content",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "UTF8"}`, `""`),
+			expectErr:    true,
+		},
+		{
+			name:         "not an email",
+			notification: sesActionNotification(`{"type": "SNS", "encoding": "UTF8"}`, `"no headers here"`),
+			expectErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := parsePayload(context.Background(), snsMessage(t, tt.notification), nil)
+			if err != nil {
+				t.Fatalf("parsePayload() error = %v", err)
+			}
+			notification := payload.notification
+			if notification.Receipt.Action.Type != sesActionSNS {
+				t.Errorf("Receipt.Action.Type = %v, want %v", notification.Receipt.Action.Type, sesActionSNS)
+			}
+
+			result, err := notification.email()
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("email() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.expectErr && isRetryable(err) {
+				t.Errorf("email() error = %v, want a permanent error", err)
+			}
+			if !tt.expectErr && string(result) != tt.expected {
+				t.Errorf("email() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMessageProcessorSNSAction(t *testing.T) {
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"user@example.com"},
+		DefaultMailbox: "user@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{}
+	// Without a bucket there is no S3 client to fetch the email from
+	processMessage := newMessageProcessor(&emailPipeline{
+		live:   newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+		ledger: newDeliveryLedger(time.Hour),
+	})
+
+	encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString([]byte(testEmail)))
+	notification := sesActionNotification(`{"type": "SNS", "topicArn": "arn:aws:sns:us-east-1:123456789012:ses-inbound", "encoding": "BASE64"}`, string(encoded))
+	// Wrapped in SNS, and on its own as raw message delivery sends it
+	for _, message := range []sqsTypes.Message{
+		snsMessage(t, notification),
+		{MessageId: aws.String("sqs-2"), Body: aws.String(notification)},
+	} {
+		if err := processMessage(context.Background(), message); err != nil {
+			t.Fatalf("processMessage() error = %v", err)
+		}
+	}
+
+	expected := [][]string{{"user@example.com"}, {"user@example.com"}}
+	if !reflect.DeepEqual(deliverer.calls, expected) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expected)
+	}
+}
+
+// s3Event returns an S3 event notification for the given event and key.
+func s3Event(eventName, key string) string {
+	return `{"Records": [{"eventSource": "aws:s3", "eventName": "` + eventName + `", "s3": {"bucket": {"name": "mail"}, "object": {"key": "` + key + `"}}}]}`
+}
+
+func TestParsePayload(t *testing.T) {
+	notification := sesActionNotification(`{"type": "S3", "bucketName": "mail", "objectKey": "inbound/a"}`, `""`)
+
+	tests := []struct {
+		name                 string
+		body                 string
+		sns                  bool
+		expectedNotification bool
+		expected             []storedEmail
+		expectErr            bool
+	}{
+		{
+			name:                 "ses notification in sns",
+			body:                 notification,
+			sns:                  true,
+			expectedNotification: true,
+		},
+		{
+			name:                 "ses notification",
+			body:                 notification,
+			expectedNotification: true,
+		},
+		{
+			name:     "s3 event",
+			body:     s3Event("ObjectCreated:Put", "inbound/a+b%40c"),
+			expected: []storedEmail{{bucket: "mail", key: "inbound/a b@c"}},
+		},
+		{
+			name:     "s3 event in sns",
+			body:     s3Event("ObjectCreated:Put", "inbound/a"),
+			sns:      true,
+			expected: []storedEmail{{bucket: "mail", key: "inbound/a"}},
+		},
+		{
+			name: "s3 event for a removed object",
+			body: s3Event("ObjectRemoved:Delete", "inbound/a"),
+		},
+		{
+			name: "ses setup notification",
+			body: s3Event("ObjectCreated:Put", "inbound/AMAZON_SES_SETUP_NOTIFICATION"),
+		},
+		{
+			name:     "eventbridge event",
+			body:     `{"source": "aws.s3", "detail-type": "Object Created", "detail": {"bucket": {"name": "mail"}, "object": {"key": "inbound/a"}}}`,
+			expected: []storedEmail{{bucket: "mail", key: "inbound/a"}},
+		},
+		{
+			name: "eventbridge event for a removed object",
+			body: `{"source": "aws.s3", "detail-type": "Object Deleted", "detail": {"bucket": {"name": "mail"}, "object": {"key": "inbound/a"}}}`,
+		},
+		{
+			name: "s3 test event",
+			body: `{"Service": "Amazon S3", "Event": "s3:TestEvent", "Bucket": "mail"}`,
+		},
+		{
+			name:      "subscription confirmation",
+			body:      `{"Type": "SubscriptionConfirmation", "TopicArn": "arn:aws:sns:us-east-1:123456789012:ses-inbound", "Message": "You have chosen to subscribe"}`,
+			expectErr: true,
+		},
+		{
+			name:      "sns notification without a message",
+			body:      `{"Type": "Notification", "TopicArn": "arn:aws:sns:us-east-1:123456789012:ses-inbound"}`,
+			expectErr: true,
+		},
+		{
+			name:      "sns notification with a text message",
+			body:      "hello",
+			sns:       true,
+			expectErr: true,
+		},
+		{
+			name:      "unrecognized payload",
+			body:      `{"hello": "world"}`,
+			expectErr: true,
+		},
+		{
+			name:      "not json",
+			body:      "hello",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := sqsTypes.Message{MessageId: aws.String("sqs-1"), Body: aws.String(tt.body)}
+			if tt.sns {
+				message = snsMessage(t, tt.body)
+			}
+
+			payload, err := parsePayload(context.Background(), message, nil)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parsePayload() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.expectErr {
+				if isRetryable(err) {
+					t.Errorf("parsePayload() error = %v, want a permanent error", err)
+				}
+				return
+			}
+			if (payload.notification != nil) != tt.expectedNotification {
+				t.Errorf("parsePayload() notification = %v, want one %v", payload.notification, tt.expectedNotification)
+			}
+			if !reflect.DeepEqual(payload.objects, tt.expected) {
+				t.Errorf("parsePayload() objects = %v, want %v", payload.objects, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMessageProcessorS3Event(t *testing.T) {
+	resolver, err := newRecipientResolver(RecipientsConfig{
+		Mailboxes:      []string{"user@example.com"},
+		DefaultMailbox: "user@example.com",
+		Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+	})
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverer := &recordingDeliverer{}
+	processMessage := newMessageProcessor(&emailPipeline{
+		live:     newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+		s3Client: &fakeReplayS3{objects: map[string]fakeReplayObject{"inbound/a": {body: testEmail}}},
+		ledger:   newDeliveryLedger(time.Hour),
+	})
+
+	message := sqsTypes.Message{MessageId: aws.String("sqs-1"), Body: aws.String(s3Event("ObjectCreated:Put", "inbound/a"))}
+	if err := processMessage(context.Background(), message); err != nil {
+		t.Fatalf("processMessage() error = %v", err)
+	}
+
+	expected := [][]string{{"user@example.com"}}
+	if !reflect.DeepEqual(deliverer.calls, expected) {
+		t.Errorf("delivered to %v, want %v", deliverer.calls, expected)
+	}
+
+	// A missing email is reported so that the message is retried
+	message.Body = aws.String(s3Event("ObjectCreated:Put", "inbound/missing"))
+	if err := processMessage(context.Background(), message); err == nil {
+		t.Errorf("processMessage() error = nil for a missing email")
+	}
+}
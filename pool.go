@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// clientPool keeps LMTP sessions open between deliveries. Sessions are reset
+// with RSET when they are returned and checked with NOOP before they are
+// reused. At most maxSize sessions are open at once, and idle sessions are
+// closed after idleTimeout.
+//
+// A pool with a maxSize of zero doesn't reuse sessions: every Get dials a new
+// one and every Put closes it.
+type clientPool struct {
+	dial        func(ctx context.Context) (*smtp.Client, error)
+	maxSize     int
+	idleTimeout time.Duration
+
+	slots chan struct{}
+	done  chan struct{}
+
+	mu     sync.Mutex
+	idle   []*pooledClient
+	closed bool
+}
+
+// pooledClient is a session checked out from a clientPool.
+type pooledClient struct {
+	*smtp.Client
+	lastUsed time.Time
+}
+
+func newClientPool(dial func(ctx context.Context) (*smtp.Client, error), maxSize int, idleTimeout time.Duration) *clientPool {
+	p := &clientPool{
+		dial:        dial,
+		maxSize:     maxSize,
+		idleTimeout: idleTimeout,
+		done:        make(chan struct{}),
+	}
+	if maxSize > 0 {
+		p.slots = make(chan struct{}, maxSize)
+		go p.reapIdle()
+	}
+	return p
+}
+
+// Get returns an idle session if a healthy one is available, or dials a new
+// one. It blocks while the pool is at its maximum size.
+func (p *clientPool) Get(ctx context.Context) (*pooledClient, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for {
+		pc := p.popIdle()
+		if pc == nil {
+			break
+		}
+		if err := pc.Noop(); err != nil {
+			slog.Debug("discarding unhealthy pooled session", "err", err)
+			_ = pc.Close()
+			continue
+		}
+		return pc, nil
+	}
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return &pooledClient{Client: c}, nil
+}
+
+// Put returns a session to the pool. Sessions that aren't reusable, that
+// can't be reset, or that are returned to a closed pool are closed instead.
+func (p *clientPool) Put(pc *pooledClient, reusable bool) {
+	defer p.release()
+
+	if reusable && p.maxSize > 0 {
+		if err := pc.Reset(); err == nil {
+			p.mu.Lock()
+			if !p.closed {
+				pc.lastUsed = time.Now()
+				p.idle = append(p.idle, pc)
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+		}
+	}
+	quitClient(pc.Client)
+}
+
+// Close closes all idle sessions. Sessions that are checked out are closed
+// when they are returned.
+func (p *clientPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, pc := range idle {
+		quitClient(pc.Client)
+	}
+	return nil
+}
+
+// popIdle removes and returns the most recently used idle session that
+// hasn't timed out, or nil if there isn't one.
+func (p *clientPool) popIdle() *pooledClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(pc.lastUsed) <= p.idleTimeout {
+			return pc
+		}
+		go quitClient(pc.Client)
+	}
+	return nil
+}
+
+func (p *clientPool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// reapIdle closes sessions that have been idle for longer than the idle
+// timeout until the pool is closed.
+func (p *clientPool) reapIdle() {
+	ticker := time.NewTicker(max(p.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		var expired []*pooledClient
+		active := p.idle[:0]
+		for _, pc := range p.idle {
+			if time.Since(pc.lastUsed) > p.idleTimeout {
+				expired = append(expired, pc)
+			} else {
+				active = append(active, pc)
+			}
+		}
+		p.idle = active
+		p.mu.Unlock()
+
+		for _, pc := range expired {
+			quitClient(pc.Client)
+		}
+	}
+}
+
+// quitClient ends a session with QUIT, closing the connection if the server
+// doesn't answer.
+func quitClient(c *smtp.Client) {
+	if err := c.Quit(); err != nil {
+		_ = c.Close()
+	}
+}
+
+// sessionUsable reports whether a session can be reused after a transaction
+// that ended with err. Protocol-level failures leave the session intact;
+// anything else, such as a network error, may not have.
+func sessionUsable(err error) bool {
+	if err == nil {
+		return true
+	}
+	var smtpErr *smtp.SMTPError
+	var rcptErrs recipientErrors
+	return errors.As(err, &smtpErr) || errors.As(err, &rcptErrs)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	smtp "github.com/emersion/go-smtp"
+)
+
+// countingListener counts accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startCountingLMTPServer(t *testing.T, backend *testMailBackend) (*countingListener, *smtp.Server) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	counting := &countingListener{Listener: l}
+
+	server := smtp.NewServer(backend)
+	server.LMTP = true
+	server.Domain = "localhost"
+	go server.Serve(counting)
+	t.Cleanup(func() { server.Close() })
+	return counting, server
+}
+
+func deliverTestMessage(t *testing.T, deliverer Deliverer, rcpt string) error {
+	t.Helper()
+	return deliverer.Deliver(context.Background(), Envelope{Recipients: []string{rcpt}}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+}
+
+func TestLMTPDelivererReusesSessions(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{poolSize: 2, poolIdleTimeout: time.Minute})
+	defer deliverer.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	if got := len(backend.deliveries("a@example.com")); got != 3 {
+		t.Errorf("deliveries = %d, want 3", got)
+	}
+	if got := l.accepted.Load(); got != 1 {
+		t.Errorf("connections = %d, want 1", got)
+	}
+}
+
+func TestLMTPDelivererWithoutPool(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{})
+	defer deliverer.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+			t.Fatalf("Deliver() error = %v", err)
+		}
+	}
+
+	if got := l.accepted.Load(); got != 2 {
+		t.Errorf("connections = %d, want 2", got)
+	}
+}
+
+func TestLMTPDelivererReplacesDeadSessions(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{poolSize: 1, poolIdleTimeout: time.Minute})
+	defer deliverer.Close()
+
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+
+	// Kill the idle session behind the pool's back; the NOOP health check
+	// should notice and a new session should be dialed.
+	deliverer.backends[0].pool.mu.Lock()
+	_ = deliverer.backends[0].pool.idle[0].Close()
+	deliverer.backends[0].pool.mu.Unlock()
+
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if got := l.accepted.Load(); got != 2 {
+		t.Errorf("connections = %d, want 2", got)
+	}
+}
+
+func TestClientPoolIdleTimeout(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	deliverer := newLMTPDeliverer([]endpoint{{network: "tcp", address: l.Addr().String()}}, "from@example.com", clientOptions{}, lmtpOptions{poolSize: 1, poolIdleTimeout: 10 * time.Millisecond})
+	defer deliverer.Close()
+
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := deliverTestMessage(t, deliverer, "a@example.com"); err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if got := l.accepted.Load(); got != 2 {
+		t.Errorf("connections = %d, want 2", got)
+	}
+}
+
+func TestClientPoolMaxSize(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	opts := clientOptions{lmtp: true}
+	pool := newClientPool(func(ctx context.Context) (*smtp.Client, error) {
+		return dialClient(ctx, "tcp", l.Addr().String(), opts)
+	}, 1, time.Minute)
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Get() on a full pool error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	pool.Put(first, true)
+	second, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if second != first {
+		t.Errorf("Get() did not reuse the idle session")
+	}
+	pool.Put(second, true)
+}
+
+func TestClientPoolClose(t *testing.T) {
+	backend := &testMailBackend{}
+	l, _ := startCountingLMTPServer(t, backend)
+
+	opts := clientOptions{lmtp: true}
+	pool := newClientPool(func(ctx context.Context) (*smtp.Client, error) {
+		return dialClient(ctx, "tcp", l.Addr().String(), opts)
+	}, 2, time.Minute)
+
+	idle, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	busy, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	pool.Put(idle, true)
+
+	pool.Close()
+	if len(pool.idle) != 0 {
+		t.Errorf("idle sessions after Close() = %d, want 0", len(pool.idle))
+	}
+
+	// Sessions returned after Close are closed rather than kept.
+	pool.Put(busy, true)
+	if len(pool.idle) != 0 {
+		t.Errorf("idle sessions after Put() on a closed pool = %d, want 0", len(pool.idle))
+	}
+	if err := busy.Noop(); err == nil {
+		t.Errorf("session returned to a closed pool is still open")
+	}
+}
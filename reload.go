@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reloadable is the part of the configuration that can change without a
+// restart: which mailboxes mail is delivered to and how it is routed.
+type reloadable struct {
+	resolver  *recipientResolver
+	deliverer Deliverer
+
+	// refs counts the messages being processed with this configuration. Once
+	// it has been replaced and the last of them finishes, its deliverer is
+	// closed unless the replacement kept it.
+	refs           atomic.Int64
+	retired        atomic.Bool
+	closeDeliverer bool
+	closeOnce      sync.Once
+}
+
+// release marks a message as finished with r.
+func (r *reloadable) release() {
+	if r.refs.Add(-1) == 0 && r.retired.Load() {
+		r.close()
+	}
+}
+
+// retire marks r as replaced, closing its deliverer once no message is using
+// it if closeDeliverer is set.
+func (r *reloadable) retire(closeDeliverer bool) {
+	r.closeDeliverer = closeDeliverer
+	r.retired.Store(true)
+	if r.refs.Load() == 0 {
+		r.close()
+	}
+}
+
+func (r *reloadable) close() {
+	r.closeOnce.Do(func() {
+		if !r.closeDeliverer {
+			return
+		}
+		if closer, ok := r.deliverer.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				slog.Error("failed to close replaced deliverer", "err", err)
+				return
+			}
+		}
+		slog.Info("closed replaced deliverer")
+	})
+}
+
+// liveConfig holds the running configuration and swaps in a new recipient and
+// delivery configuration when it is reloaded. Messages that are already being
+// processed finish with the configuration they started with.
+type liveConfig struct {
+	path      string
+	lookupEnv func(string) (string, bool)
+	// newDeliverer builds the deliverer for a changed delivery configuration.
+	newDeliverer func(DeliveryConfig) (Deliverer, error)
+
+	// mu serializes reloads and guards config.
+	mu      sync.Mutex
+	config  *Config
+	current atomic.Pointer[reloadable]
+}
+
+// newLiveConfig returns a liveConfig that starts with cfg, resolver and
+// deliverer and reloads from the config file at path and the environment.
+func newLiveConfig(path string, lookupEnv func(string) (string, bool), cfg *Config, resolver *recipientResolver, deliverer Deliverer) *liveConfig {
+	l := &liveConfig{
+		path:         path,
+		lookupEnv:    lookupEnv,
+		newDeliverer: newDeliverer,
+		config:       cfg,
+	}
+	l.current.Store(&reloadable{resolver: resolver, deliverer: deliverer})
+	return l
+}
+
+// Acquire returns the current configuration and a function to call once the
+// message using it has been processed.
+func (l *liveConfig) Acquire() (*reloadable, func()) {
+	for {
+		current := l.current.Load()
+		current.refs.Add(1)
+		// A reload may have retired current in between, in which case it
+		// mustn't be used any more
+		if l.current.Load() == current {
+			return current, current.release
+		}
+		current.release()
+	}
+}
+
+// Reload reads the configuration again and swaps in the new recipient and
+// delivery settings. If the configuration is invalid the running one is kept
+// and the error returned. Other settings only take effect after a restart.
+func (l *liveConfig) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cfg, err := loadConfig(l.path, l.lookupEnv)
+	if err != nil {
+		return err
+	}
+	resolver, err := newRecipientResolver(cfg.Recipients)
+	if err != nil {
+		return err
+	}
+
+	previous := l.current.Load()
+	deliverer := previous.deliverer
+	deliveryChanged := !reflect.DeepEqual(l.config.Delivery, cfg.Delivery)
+	if deliveryChanged {
+		if deliverer, err = l.newDeliverer(cfg.Delivery); err != nil {
+			return err
+		}
+	}
+
+	if settings := restartRequired(l.config, cfg); len(settings) > 0 {
+		slog.Warn("changed settings only take effect after a restart", "settings", settings)
+	}
+	next := *l.config
+	next.Recipients, next.Delivery = cfg.Recipients, cfg.Delivery
+	l.config = &next
+
+	l.current.Store(&reloadable{resolver: resolver, deliverer: deliverer})
+	previous.retire(deliveryChanged)
+	slog.Info("reloaded configuration", "mailboxes", cfg.Recipients.Mailboxes, "defaultMailbox", cfg.Recipients.DefaultMailbox, "aliases", resolver.aliases.Len(), "deliveryChanged", deliveryChanged)
+	return nil
+}
+
+// reload reloads the configuration and logs the outcome.
+func (l *liveConfig) reload(reason string) {
+	slog.Info("reloading configuration", "reason", reason)
+	if err := l.Reload(); err != nil {
+		slog.Error("failed to reload configuration, keeping the current one", "err", err)
+	}
+}
+
+// restartRequired returns the settings that differ between old and new but
+// aren't reloaded.
+func restartRequired(old, new *Config) []string {
+	var settings []string
+	changed := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			settings = append(settings, name)
+		}
+	}
+	changed("queues", old.Queues, new.Queues)
+	changed("healthCheckPort", old.HealthCheckPort, new.HealthCheckPort)
+	changed("workerCount", old.WorkerCount, new.WorkerCount)
+	changed("shutdownTimeout", old.ShutdownTimeout, new.ShutdownTimeout)
+	changed("visibilityTimeout", old.VisibilityTimeout, new.VisibilityTimeout)
+	changed("watchInterval", old.WatchInterval, new.WatchInterval)
+	changed("dryRun", old.DryRun, new.DryRun)
+	changed("backfill", old.Backfill, new.Backfill)
+	changed("sns", old.SNS, new.SNS)
+	changed("retry", old.Retry, new.Retry)
+	return settings
+}
+
+// watch reloads the configuration whenever the config file or alias file
+// changes, checking every interval until ctx is cancelled.
+func (l *liveConfig) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	stamps := l.fileStamps()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if current := l.fileStamps(); !reflect.DeepEqual(current, stamps) {
+			l.reload("file changed")
+			// Files that are still being written are picked up on the next
+			// tick
+			stamps = l.fileStamps()
+		}
+	}
+}
+
+// fileStamp identifies a version of a watched file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// fileStamps returns the modification time and size of the config file and
+// alias file. Files that can't be read are left out.
+func (l *liveConfig) fileStamps() map[string]fileStamp {
+	l.mu.Lock()
+	paths := []string{l.path, l.config.Recipients.AliasFile}
+	l.mu.Unlock()
+
+	stamps := make(map[string]fileStamp)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Stats reports the backends of the current deliverer.
+func (l *liveConfig) Stats() []backendStats {
+	current, release := l.Acquire()
+	defer release()
+	if reporter, ok := current.deliverer.(backendReporter); ok {
+		return reporter.Stats()
+	}
+	return nil
+}
+
+// Close closes the current deliverer. It is called once every message has
+// been processed.
+func (l *liveConfig) Close() error {
+	if closer, ok := l.current.Load().deliverer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closingDeliverer records whether it has been closed.
+type closingDeliverer struct {
+	recordingDeliverer
+	closed atomic.Bool
+}
+
+func (d *closingDeliverer) Close() error {
+	d.closed.Store(true)
+	return nil
+}
+
+const reloadConfig = `
+queues:
+  - url: https://sqs.us-east-1.amazonaws.com/123456789012/inbound
+sns:
+  topicArns: [arn:aws:sns:us-east-1:123456789012:ses-inbound]
+recipients:
+  mailboxes: [%s]
+  defaultMailbox: %s
+delivery:
+  lmtp:
+    hosts: [%s]
+    from: ses@example.com
+`
+
+// newTestLiveConfig loads the config file at path into a liveConfig whose
+// deliverers are closingDeliverers.
+func newTestLiveConfig(t *testing.T, path string) (*liveConfig, *[]*closingDeliverer) {
+	t.Helper()
+	cfg, err := loadConfig(path, envMap(nil))
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	resolver, err := newRecipientResolver(cfg.Recipients)
+	if err != nil {
+		t.Fatalf("newRecipientResolver() error = %v", err)
+	}
+	deliverers := []*closingDeliverer{{}}
+	live := newLiveConfig(path, envMap(nil), cfg, resolver, deliverers[0])
+	live.newDeliverer = func(DeliveryConfig) (Deliverer, error) {
+		deliverers = append(deliverers, &closingDeliverer{})
+		return deliverers[len(deliverers)-1], nil
+	}
+	return live, &deliverers
+}
+
+func writeReloadConfig(t *testing.T, path, mailboxes, defaultMailbox, host string) {
+	t.Helper()
+	content := []byte(fmt.Sprintf(reloadConfig, mailboxes, defaultMailbox, host))
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+}
+
+func TestLiveConfigReload(t *testing.T) {
+	path := writeConfigFile(t, "")
+	writeReloadConfig(t, path, "a@example.com", "a@example.com", "mail1:24")
+	live, deliverers := newTestLiveConfig(t, path)
+
+	writeReloadConfig(t, path, "a@example.com, b@example.com", "b@example.com", "mail1:24")
+	if err := live.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	current, release := live.Acquire()
+	defer release()
+	expected := []string{"b@example.com"}
+	if result, _ := current.resolver.Resolve([]string{"b@example.com"}); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Resolve() = %v, want %v", result, expected)
+	}
+	if result, _ := current.resolver.Resolve([]string{"c@example.com"}); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Resolve() = %v, want the new default mailbox %v", result, expected)
+	}
+	// The delivery settings didn't change, so the deliverer is kept
+	if len(*deliverers) != 1 || current.deliverer != (*deliverers)[0] {
+		t.Errorf("Reload() replaced the deliverer although delivery settings didn't change")
+	}
+	if (*deliverers)[0].closed.Load() {
+		t.Errorf("Reload() closed the deliverer that is still in use")
+	}
+}
+
+func TestLiveConfigReloadInvalid(t *testing.T) {
+	path := writeConfigFile(t, "")
+	writeReloadConfig(t, path, "a@example.com", "a@example.com", "mail1:24")
+	live, _ := newTestLiveConfig(t, path)
+	before, release := live.Acquire()
+	release()
+
+	writeReloadConfig(t, path, "/[/", "a@example.com", "mail1:24")
+	if err := live.Reload(); err == nil {
+		t.Fatal("Reload() error = nil, want an error")
+	}
+
+	after, release := live.Acquire()
+	defer release()
+	if after != before {
+		t.Errorf("Reload() replaced the configuration although the new one is invalid")
+	}
+}
+
+func TestLiveConfigReloadDelivery(t *testing.T) {
+	path := writeConfigFile(t, "")
+	writeReloadConfig(t, path, "a@example.com", "a@example.com", "mail1:24")
+	live, deliverers := newTestLiveConfig(t, path)
+
+	// A message in flight keeps using the old deliverer until it finishes
+	inFlight, release := live.Acquire()
+
+	writeReloadConfig(t, path, "a@example.com", "a@example.com", "mail2:24")
+	if err := live.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if len(*deliverers) != 2 {
+		t.Fatalf("Reload() created %d deliverers, want 1", len(*deliverers)-1)
+	}
+	old, replacement := (*deliverers)[0], (*deliverers)[1]
+	if inFlight.deliverer != old {
+		t.Errorf("in-flight message deliverer changed during reload")
+	}
+	if old.closed.Load() {
+		t.Errorf("Reload() closed the old deliverer while a message was using it")
+	}
+
+	release()
+	if !old.closed.Load() {
+		t.Errorf("old deliverer wasn't closed once the in-flight message finished")
+	}
+
+	current, release := live.Acquire()
+	defer release()
+	if current.deliverer != replacement {
+		t.Errorf("Acquire() deliverer = %p, want the replacement %p", current.deliverer, replacement)
+	}
+	if replacement.closed.Load() {
+		t.Errorf("replacement deliverer was closed")
+	}
+}
+
+func TestLiveConfigWatch(t *testing.T) {
+	path := writeConfigFile(t, "")
+	writeReloadConfig(t, path, "a@example.com", "a@example.com", "mail1:24")
+	live, _ := newTestLiveConfig(t, path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go live.watch(ctx, 10*time.Millisecond)
+
+	writeReloadConfig(t, path, "a@example.com, b@example.com", "a@example.com", "mail1:24")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; time.Now().Before(deadline); i++ {
+		// Keep touching the file, since watch may only have taken its first
+		// look after the write, and modification times may be coarse
+		touched := time.Now().Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, touched, touched); err != nil {
+			t.Fatalf("failed to touch config file: %v", err)
+		}
+		current, release := live.Acquire()
+		matched := current.resolver.mailboxes.Match("b@example.com")
+		release()
+		if matched {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("watch() didn't reload the changed config file")
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := defaultConfig()
+	new := defaultConfig()
+	new.WorkerCount = 8
+	new.Recipients.DefaultMailbox = "user@example.com"
+
+	expected := []string{"workerCount"}
+	if result := restartRequired(old, new); !reflect.DeepEqual(result, expected) {
+		t.Errorf("restartRequired() = %v, want %v", result, expected)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sesSetupNotificationKey is the name of the object SES writes to a bucket
+// when a receipt rule is set up. It isn't an email.
+const sesSetupNotificationKey = "AMAZON_SES_SETUP_NOTIFICATION"
+
+// replayCommand redelivers emails that are still stored in S3, given as a list
+// of keys or found by listing a prefix, optionally limited to a time range.
+// Every email goes through the same fetch, resolve and deliver steps as the
+// ones received from SQS.
+func replayCommand(args []string, stdout, stderr io.Writer) int {
+	flags := newFlagSet("replay", stderr)
+	configPath := configFlag(flags)
+	bucket := flags.String("bucket", "", "bucket the emails are stored in (required)")
+	prefix := flags.String("prefix", "", "replay the emails whose key starts with prefix")
+	since := flags.String("since", "", "replay the emails stored at or after this time, in RFC 3339 format or YYYY-MM-DD")
+	until := flags.String("until", "", "replay the emails stored before this time, in RFC 3339 format or YYYY-MM-DD")
+	keysFile := flags.String("keys-file", "", "file listing the keys of the emails to replay, one per line, or - for stdin")
+	to := flags.String("to", "", "comma-separated mailboxes to deliver to instead of the recipients in the headers")
+	dryRun := flags.Bool("dry-run", false, "log where each email would be delivered without delivering it")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: ses2lmtp replay -bucket bucket [-prefix prefix] [-since time] [-until time] [flags]\n")
+		fmt.Fprintf(stderr, "       ses2lmtp replay -bucket bucket [-keys-file file] [flags] [key ...]\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	keys := flags.Args()
+	if *keysFile != "" {
+		fileKeys, err := readReplayKeys(*keysFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to read keys: %v\n", err)
+			return 2
+		}
+		keys = append(keys, fileKeys...)
+	}
+	start, err := parseTime(*since)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -since: %v\n", err)
+		return 2
+	}
+	end, err := parseTime(*until)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -until: %v\n", err)
+		return 2
+	}
+	switch {
+	case *bucket == "":
+		fmt.Fprintln(stderr, "-bucket is required")
+		return 2
+	case len(keys) > 0 && (*prefix != "" || *since != "" || *until != ""):
+		fmt.Fprintln(stderr, "keys can't be combined with -prefix, -since or -until")
+		return 2
+	case !end.IsZero() && !end.After(start):
+		fmt.Fprintln(stderr, "-until must be after -since")
+		return 2
+	}
+
+	cfg, err := loadConfig(*configPath, os.LookupEnv)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+	resolver, err := newRecipientResolver(cfg.Recipients)
+	if err != nil {
+		printConfigError(stderr, err)
+		return 1
+	}
+	*dryRun = *dryRun || cfg.DryRun.Enabled
+	deliver := newDeliverer
+	if *dryRun {
+		deliver = newDryRunDeliverer
+	}
+	deliverer, err := deliver(cfg.Delivery)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to configure delivery: %v\n", err)
+		return 1
+	}
+	live := newLiveConfig(*configPath, os.LookupEnv, cfg, resolver, deliverer)
+	defer func() {
+		if err := live.Close(); err != nil {
+			slog.Error("failed to close deliverer", "err", err)
+		}
+	}()
+
+	// Stop after the current email on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load aws config: %v\n", err)
+		return 1
+	}
+	s3Client := s3.NewFromConfig(awsConfig)
+
+	if len(keys) == 0 {
+		keys, err = listReplayKeys(ctx, s3Client, *bucket, *prefix, start, end)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to list emails: %v\n", err)
+			return 1
+		}
+	}
+
+	r := &replayer{
+		out: stdout,
+		pipeline: &emailPipeline{
+			live:     live,
+			s3Client: s3Client,
+			ledger:   newDeliveryLedger(24 * time.Hour),
+			dryRun:   *dryRun,
+		},
+		bucket: *bucket,
+		to:     splitList(*to),
+	}
+	return r.run(ctx, keys)
+}
+
+// readReplayKeys reads object keys from the file at path, or from stdin if
+// path is "-", one per line. Blank lines are skipped.
+func readReplayKeys(path string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// listReplayKeys returns the keys of the objects under prefix in bucket that
+// were stored at or after start and, unless end is zero, before end.
+func listReplayKeys(ctx context.Context, client s3.ListObjectsV2APIClient, bucket, prefix string, start, end time.Time) ([]string, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			key := Value(object.Key)
+			if path.Base(key) == sesSetupNotificationKey || strings.HasSuffix(key, "/") {
+				continue
+			}
+			if modified := Value(object.LastModified); modified.Before(start) || (!end.IsZero() && !modified.Before(end)) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// replayer redelivers emails stored in S3 and reports on each of them.
+type replayer struct {
+	out      io.Writer
+	pipeline *emailPipeline
+	bucket   string
+	// to replaces the recipients of every email if it isn't empty. These
+	// mailboxes are delivered to as given, without resolving them.
+	to []string
+
+	delivered, failed, skipped int
+}
+
+// run replays the emails at keys, stopping early if ctx is cancelled. It
+// returns the exit status, which is non-zero if any email failed or wasn't
+// replayed.
+func (r *replayer) run(ctx context.Context, keys []string) int {
+	fmt.Fprintf(r.out, "replaying %d emails from s3://%s\n", len(keys), r.bucket)
+	interrupted := false
+	for i, key := range keys {
+		if ctx.Err() != nil {
+			fmt.Fprintf(r.out, "interrupted, %d emails not replayed\n", len(keys)-i)
+			interrupted = true
+			break
+		}
+		progress := fmt.Sprintf("[%d/%d]", i+1, len(keys))
+		recipients, err := r.replay(ctx, key)
+		switch {
+		case err != nil:
+			r.failed++
+			fmt.Fprintf(r.out, "%s FAIL  %s: %v\n", progress, key, err)
+		case len(recipients) == 0:
+			r.skipped++
+			fmt.Fprintf(r.out, "%s SKIP  %s: every recipient was dropped\n", progress, key)
+		default:
+			r.delivered++
+			fmt.Fprintf(r.out, "%s OK    %s: %s\n", progress, key, strings.Join(recipients, ", "))
+		}
+	}
+
+	verb := "delivered"
+	if r.pipeline.dryRun {
+		verb = "would deliver"
+	}
+	fmt.Fprintf(r.out, "%s %d, failed %d, skipped %d of %d emails\n", verb, r.delivered, r.failed, r.skipped, len(keys))
+	if r.failed > 0 || interrupted {
+		return 1
+	}
+	return 0
+}
+
+// replay delivers the email at key and returns the mailboxes it was
+// delivered to.
+func (r *replayer) replay(ctx context.Context, key string) ([]string, error) {
+	return r.pipeline.deliverStored(ctx, r.bucket, key, r.to)
+}
+
+// deliverStored delivers the email at key in bucket and returns the mailboxes
+// it was delivered to. Stored emails don't carry the SES envelope, so they are
+// delivered to the resolved recipients in their headers, or to the mailboxes
+// in to as given if it isn't empty.
+func (p *emailPipeline) deliverStored(ctx context.Context, bucket, key string, to []string) ([]string, error) {
+	current, release := p.live.Acquire()
+	defer release()
+
+	emailBody, err := p.fetch(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	emailMsg, err := mail.ReadMessage(bytes.NewReader(emailBody))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := Envelope{From: senderFromHeaders(emailMsg.Header)}
+	var rejected recipientErrors
+	if len(to) > 0 {
+		envelope.Recipients = to
+	} else {
+		original := recipientsFromHeaders(emailMsg.Header)
+		if len(original) == 0 {
+			return nil, permanent(errors.New("no recipients in the headers"))
+		}
+		envelope.Recipients, rejected = current.resolver.Resolve(original)
+	}
+
+	err = p.deliver(ctx, current.deliverer, bucket+"/"+key, envelope, rejected, emailBody)
+	return envelope.Recipients, err
+}
+
+// sesReceivedFor matches the Received header SES adds to an email it stores,
+// which names the envelope recipient when there is just one.
+var sesReceivedFor = regexp.MustCompile(`(?i)\bby\s+\S+\.amazonaws\.com\b.*\bfor\s+<?([^\s<>;]+@[^\s<>;]+?)>?\s*;`)
+
+// recipientsFromHeaders returns the recipients of a stored email, which comes
+// without the SES envelope. The recipient in the topmost Received header is
+// used if SES recorded one there; otherwise the addresses in the To and Cc
+// headers are, without duplicates, so blind copies are missed. The X-SES-*
+// headers only hold verdicts and signatures, not recipients.
+func recipientsFromHeaders(header mail.Header) []string {
+	if received := header["Received"]; len(received) > 0 {
+		if match := sesReceivedFor.FindStringSubmatch(received[0]); match != nil {
+			return []string{match[1]}
+		}
+	}
+
+	var recipients []string
+	seen := make(map[string]bool)
+	for _, name := range []string{"To", "Cc"} {
+		addresses, err := header.AddressList(name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if normalized := strings.ToLower(address.Address); !seen[normalized] {
+				seen[normalized] = true
+				recipients = append(recipients, address.Address)
+			}
+		}
+	}
+	return recipients
+}
+
+// senderFromHeaders returns the envelope sender of an email, taken from the
+// Return-Path header SES adds or, failing that, the From header.
+func senderFromHeaders(header mail.Header) string {
+	for _, name := range []string{"Return-Path", "From"} {
+		if addresses, err := header.AddressList(name); err == nil && len(addresses) > 0 {
+			return addresses[0].Address
+		}
+	}
+	return ""
+}
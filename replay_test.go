@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeReplayObject struct {
+	body     string
+	modified time.Time
+}
+
+// fakeReplayS3 serves objects from a single bucket, listing them pageSize at a
+// time.
+type fakeReplayS3 struct {
+	objects  map[string]fakeReplayObject
+	pageSize int
+}
+
+func (f *fakeReplayS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	object, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(object.body))}, nil
+}
+
+func (f *fakeReplayS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, Value(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	start, _ := strconv.Atoi(Value(params.ContinuationToken))
+	end := min(start+f.pageSize, len(keys))
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	for _, key := range keys[start:end] {
+		output.Contents = append(output.Contents, s3Types.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(f.objects[key].modified),
+		})
+	}
+	if end < len(keys) {
+		output.NextContinuationToken = aws.String(strconv.Itoa(end))
+	}
+	return output, nil
+}
+
+func TestListReplayKeys(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	client := &fakeReplayS3{pageSize: 2, objects: map[string]fakeReplayObject{
+		"inbound/AMAZON_SES_SETUP_NOTIFICATION": {modified: day(1)},
+		"inbound/a":                             {modified: day(1)},
+		"inbound/b":                             {modified: day(2)},
+		"inbound/c":                             {modified: day(3)},
+		"other/d":                               {modified: day(2)},
+	}}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		start    time.Time
+		end      time.Time
+		expected []string
+	}{
+		{
+			name:     "whole bucket",
+			expected: []string{"inbound/a", "inbound/b", "inbound/c", "other/d"},
+		},
+		{
+			name:     "prefix",
+			prefix:   "inbound/",
+			expected: []string{"inbound/a", "inbound/b", "inbound/c"},
+		},
+		{
+			name:     "time range",
+			prefix:   "inbound/",
+			start:    day(2),
+			end:      day(3),
+			expected: []string{"inbound/b"},
+		},
+		{
+			name:     "open-ended time range",
+			start:    day(2),
+			expected: []string{"inbound/b", "inbound/c", "other/d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := listReplayKeys(context.Background(), client, "mail", tt.prefix, tt.start, tt.end)
+			if err != nil {
+				t.Fatalf("listReplayKeys() error = %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("listReplayKeys() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRecipientsFromHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  string
+		expected []string
+	}{
+		{
+			name:     "to and cc",
+			headers:  "To: Alice <alice@example.com>, bob@example.com\r\nCc: carol@example.com, Bob@example.com\r\n",
+			expected: []string{"alice@example.com", "bob@example.com", "carol@example.com"},
+		},
+		{
+			name:     "malformed header is skipped",
+			headers:  "To: undisclosed-recipients:;\r\nCc: carol@example.com\r\n",
+			expected: []string{"carol@example.com"},
+		},
+		{
+			name: "recipient recorded by ses",
+			headers: "Return-Path: <sender@example.net>\r\n" +
+				"Received: from mail.example.net (mail.example.net [192.0.2.1])\r\n" +
+				" by inbound-smtp.us-east-1.amazonaws.com with SMTP id abc123\r\n" +
+				" for hidden@example.com;\r\n" +
+				" Mon, 01 Jan 2024 12:00:00 +0000 (UTC)\r\n" +
+				"Received: from client (client [192.0.2.2]) by mail.example.net for <other@example.org>;\r\n" +
+				" Mon, 01 Jan 2024 11:59:59 +0000\r\n" +
+				"To: list@example.com\r\n",
+			expected: []string{"hidden@example.com"},
+		},
+		{
+			name:     "received header without a recipient",
+			headers:  "Received: from mail.example.net by inbound-smtp.us-east-1.amazonaws.com with SMTP id abc123;\r\n Mon, 01 Jan 2024 12:00:00 +0000\r\nTo: list@example.com\r\n",
+			expected: []string{"list@example.com"},
+		},
+		{
+			name:    "no recipients",
+			headers: "From: sender@example.com\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := mail.ReadMessage(strings.NewReader(tt.headers + "\r\nbody\r\n"))
+			if err != nil {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if result := recipientsFromHeaders(msg.Header); !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("recipientsFromHeaders() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	client := &fakeReplayS3{objects: map[string]fakeReplayObject{
+		"inbound/a": {body: "Return-Path: <sender@example.net>\r\nFrom: sender@example.net\r\nTo: a@example.com\r\nCc: other@example.org\r\n\r\nbody\r\n"},
+		"inbound/b": {body: "From: sender@example.net\r\nSubject: no recipients\r\n\r\nbody\r\n"},
+	}}
+
+	tests := []struct {
+		name           string
+		to             []string
+		keys           []string
+		expectedCalls  [][]string
+		expectedStatus int
+		expectedOutput []string
+	}{
+		{
+			name:          "recipients from headers",
+			keys:          []string{"inbound/a"},
+			expectedCalls: [][]string{{"a@example.com"}},
+			expectedOutput: []string{
+				"[1/1] OK    inbound/a: a@example.com",
+				"delivered 1, failed 0, skipped 0 of 1 emails",
+			},
+		},
+		{
+			name:          "recipient override",
+			to:            []string{"restore@example.com"},
+			keys:          []string{"inbound/a", "inbound/b"},
+			expectedCalls: [][]string{{"restore@example.com"}, {"restore@example.com"}},
+			expectedOutput: []string{
+				"[1/2] OK    inbound/a: restore@example.com",
+				"[2/2] OK    inbound/b: restore@example.com",
+			},
+		},
+		{
+			name:           "failures",
+			keys:           []string{"inbound/missing", "inbound/b"},
+			expectedStatus: 1,
+			expectedOutput: []string{
+				"[1/2] FAIL  inbound/missing: failed to get object from s3",
+				"[2/2] FAIL  inbound/b: no recipients in the headers",
+				"delivered 0, failed 2, skipped 0 of 2 emails",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := newRecipientResolver(RecipientsConfig{
+				Mailboxes:      []string{"a@example.com", "default@example.com"},
+				DefaultMailbox: "default@example.com",
+				Subaddress:     SubaddressConfig{Mode: subaddressKeep},
+			})
+			if err != nil {
+				t.Fatalf("newRecipientResolver() error = %v", err)
+			}
+			deliverer := &recordingDeliverer{}
+			var out bytes.Buffer
+			r := &replayer{
+				out: &out,
+				pipeline: &emailPipeline{
+					live:     newLiveConfig("", envMap(nil), defaultConfig(), resolver, deliverer),
+					s3Client: client,
+					ledger:   newDeliveryLedger(time.Hour),
+				},
+				bucket: "mail",
+				to:     tt.to,
+			}
+
+			if status := r.run(context.Background(), tt.keys); status != tt.expectedStatus {
+				t.Errorf("run() = %v, want %v", status, tt.expectedStatus)
+			}
+			if !reflect.DeepEqual(deliverer.calls, tt.expectedCalls) {
+				t.Errorf("delivered to %v, want %v", deliverer.calls, tt.expectedCalls)
+			}
+			for _, expected := range tt.expectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("run() output = %q, want it to contain %q", out.String(), expected)
+				}
+			}
+		})
+	}
+}
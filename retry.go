@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	smtp "github.com/emersion/go-smtp"
+)
+
+const (
+	// Permanent failure policies
+	failurePolicyDelete     = "delete"
+	failurePolicyDeadLetter = "dead-letter"
+	failurePolicyQuarantine = "quarantine"
+
+	// quarantineVisibility hides a quarantined message for as long as SQS
+	// allows. The total visibility timeout of a message is capped at 12 hours
+	// from when it was received, so this leaves room for processing time.
+	quarantineVisibility = 11 * time.Hour
+)
+
+// permanentError marks an error that will fail the same way however many
+// times the message is retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent wraps err so that isRetryable reports false for it.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// deliveredError marks a permanent error for a message that every recipient
+// able to accept it already has. Such a message isn't quarantined, as it
+// would be delivered to them again when it comes back.
+type deliveredError struct {
+	err error
+}
+
+func (e *deliveredError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveredError) Unwrap() error {
+	return e.err
+}
+
+// delivered wraps err, if there is one, to mark the message as delivered to
+// everyone but the recipients err reports.
+func delivered(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &deliveredError{err: err}
+}
+
+// isRetryable reports whether a message that failed with err may succeed if it
+// is processed again. LMTP 4xx replies, S3 throttling and network errors are
+// transient; LMTP 5xx replies, malformed payloads and missing S3 objects are
+// not. Errors that can't be classified are treated as transient so that mail
+// isn't dropped on an unexpected failure.
+func isRetryable(err error) bool {
+	// A partial delivery is retried if any failed recipient may still accept
+	// the message. This is checked first, as the checks below would find the
+	// error of any one recipient.
+	var rcptErrs recipientErrors
+	if errors.As(err, &rcptErrs) {
+		for _, rcptErr := range rcptErrs {
+			if isRetryable(rcptErr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var permanentErr *permanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code/100 != 5
+	}
+
+	var noSuchKey *s3Types.NoSuchKey
+	var noSuchBucket *s3Types.NoSuchBucket
+	if errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) {
+		return false
+	}
+
+	return true
+}
+
+// retryDelay returns how long a message should stay invisible after its
+// receiveCount'th failed attempt. The delay doubles with every attempt,
+// starting at base and capped at max.
+func retryDelay(receiveCount int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < receiveCount; i++ {
+		delay *= 2
+		if delay >= max {
+			return max
+		}
+	}
+	return min(delay, max)
+}
+
+// receiveCount returns the ApproximateReceiveCount attribute of message, or 1
+// if it wasn't requested or can't be parsed.
+func receiveCount(message sqsTypes.Message) int {
+	count, err := strconv.Atoi(message.Attributes[string(sqsTypes.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// sqsFailureAPI is the subset of the SQS client used to back off, delete,
+// dead-letter or quarantine failed messages.
+type sqsFailureAPI interface {
+	sqsVisibilityAPI
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// failureHandler decides what happens to a message that failed to process.
+type failureHandler struct {
+	sqsClient          sqsFailureAPI
+	policy             string
+	deadLetterQueueURL string
+	baseDelay          time.Duration
+	maxDelay           time.Duration
+}
+
+// handle backs off retryable failures by extending the message's visibility
+// timeout and applies the permanent failure policy to everything else.
+// queueURL is the queue the message was received from.
+func (h *failureHandler) handle(ctx context.Context, logger *slog.Logger, queueURL string, message sqsTypes.Message, cause error) {
+	// The message context may have been cancelled during shutdown, but the
+	// failure should still be recorded on the queue.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	count := receiveCount(message)
+	if isRetryable(cause) {
+		delay := retryDelay(count, h.baseDelay, h.maxDelay)
+		logger.Error("failed to process message, will retry", "err", cause, "receiveCount", count, "retryIn", delay)
+		if err := h.changeVisibility(ctx, queueURL, message, delay); err != nil {
+			logger.Error("failed to back off message", "err", err)
+		}
+		return
+	}
+
+	policy := h.policy
+	var deliveredErr *deliveredError
+	if errors.As(cause, &deliveredErr) && policy == failurePolicyQuarantine {
+		// The message would be delivered again once the quarantine ends
+		policy = failurePolicyDelete
+	}
+	logger.Error("failed to process message permanently", "err", cause, "receiveCount", count, "policy", policy)
+	switch policy {
+	case failurePolicyDelete:
+		if err := h.deleteMessage(ctx, queueURL, message); err != nil {
+			logger.Error("failed to delete message from queue", "err", err)
+			return
+		}
+		logger.Warn("deleted permanently failed message")
+	case failurePolicyDeadLetter:
+		attributes := map[string]sqsTypes.MessageAttributeValue{
+			"ErrorMessage":  {DataType: aws.String("String"), StringValue: aws.String(cause.Error())},
+			"SourceQueue":   {DataType: aws.String("String"), StringValue: aws.String(queueURL)},
+			"SourceMessage": {DataType: aws.String("String"), StringValue: aws.String(Value(message.MessageId))},
+			"ReceiveCount":  {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(count))},
+		}
+		// Only the recipients that failed still need the message
+		var rcptErrs recipientErrors
+		if deliveredErr != nil && errors.As(deliveredErr, &rcptErrs) {
+			attributes["FailedRecipients"] = sqsTypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(strings.Join(slices.Sorted(maps.Keys(rcptErrs)), ","))}
+		}
+		_, err := h.sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:          aws.String(h.deadLetterQueueURL),
+			MessageBody:       message.Body,
+			MessageAttributes: attributes,
+		})
+		if err != nil {
+			logger.Error("failed to send message to dead-letter queue", "err", err)
+			return
+		}
+		if err := h.deleteMessage(ctx, queueURL, message); err != nil {
+			logger.Error("failed to delete dead-lettered message from queue", "err", err)
+			return
+		}
+		logger.Warn("moved permanently failed message to dead-letter queue", "deadLetterQueueURL", h.deadLetterQueueURL)
+	default:
+		if err := h.changeVisibility(ctx, queueURL, message, quarantineVisibility); err != nil {
+			logger.Error("failed to quarantine message", "err", err)
+			return
+		}
+		logger.Warn("quarantined permanently failed message", "hiddenFor", quarantineVisibility)
+	}
+}
+
+func (h *failureHandler) changeVisibility(ctx context.Context, queueURL string, message sqsTypes.Message, timeout time.Duration) error {
+	_, err := h.sqsClient.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: int32(timeout.Seconds()),
+	})
+	return err
+}
+
+func (h *failureHandler) deleteMessage(ctx context.Context, queueURL string, message sqsTypes.Message) error {
+	_, err := h.sqsClient.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	})
+	return err
+}
+
+// validateFailurePolicy checks policy and, for the dead-letter policy, that a
+// dead-letter queue has been configured.
+func validateFailurePolicy(policy, deadLetterQueueURL string) error {
+	switch policy {
+	case failurePolicyDelete, failurePolicyQuarantine:
+		return nil
+	case failurePolicyDeadLetter:
+		if deadLetterQueueURL == "" {
+			return fmt.Errorf("failure policy %q requires a dead-letter queue url", policy)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown failure policy %q, expected one of %q, %q or %q", policy, failurePolicyDelete, failurePolicyDeadLetter, failurePolicyQuarantine)
+	}
+}
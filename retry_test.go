@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	smtp "github.com/emersion/go-smtp"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "lmtp 4xx",
+			err:      fmt.Errorf("failed to send email: %w", &smtp.SMTPError{Code: 452, Message: "mailbox full"}),
+			expected: true,
+		},
+		{
+			name:     "lmtp 5xx",
+			err:      fmt.Errorf("failed to send email: %w", &smtp.SMTPError{Code: 550, Message: "no such user"}),
+			expected: false,
+		},
+		{
+			name:     "network error",
+			err:      fmt.Errorf("failed to dial lmtp server: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			expected: true,
+		},
+		{
+			name:     "missing s3 object",
+			err:      fmt.Errorf("failed to get object from s3: %w", &s3Types.NoSuchKey{}),
+			expected: false,
+		},
+		{
+			name:     "missing s3 bucket",
+			err:      fmt.Errorf("failed to get object from s3: %w", &s3Types.NoSuchBucket{}),
+			expected: false,
+		},
+		{
+			name:     "permanent error",
+			err:      permanent(errors.New("malformed payload")),
+			expected: false,
+		},
+		{
+			name:     "wrapped permanent error",
+			err:      fmt.Errorf("processing: %w", permanent(errors.New("malformed payload"))),
+			expected: false,
+		},
+		{
+			name: "recipients that failed permanently",
+			err: fmt.Errorf("failed to send email: %w", recipientErrors{
+				"a@example.com": permanent(errNoRoute),
+				"b@example.com": &smtp.SMTPError{Code: 550, Message: "no such user"},
+			}),
+			expected: false,
+		},
+		{
+			name: "recipients that failed permanently and transiently",
+			err: fmt.Errorf("failed to send email: %w", recipientErrors{
+				"a@example.com": permanent(errNoRoute),
+				"b@example.com": &smtp.SMTPError{Code: 451, Message: "try again later"},
+			}),
+			expected: true,
+		},
+		{
+			name:     "unknown error",
+			err:      errors.New("something went wrong"),
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := isRetryable(tt.err)
+			if result != tt.expected {
+				t.Errorf("isRetryable() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		receiveCount int
+		base         time.Duration
+		max          time.Duration
+		expected     time.Duration
+	}{
+		{
+			name:         "first attempt",
+			receiveCount: 1,
+			base:         30 * time.Second,
+			max:          time.Hour,
+			expected:     30 * time.Second,
+		},
+		{
+			name:         "third attempt",
+			receiveCount: 3,
+			base:         30 * time.Second,
+			max:          time.Hour,
+			expected:     2 * time.Minute,
+		},
+		{
+			name:         "capped at max",
+			receiveCount: 10,
+			base:         30 * time.Second,
+			max:          time.Hour,
+			expected:     time.Hour,
+		},
+		{
+			name:         "very large receive count",
+			receiveCount: 1000,
+			base:         30 * time.Second,
+			max:          time.Hour,
+			expected:     time.Hour,
+		},
+		{
+			name:         "base equals max",
+			receiveCount: 1,
+			base:         time.Minute,
+			max:          time.Minute,
+			expected:     time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := retryDelay(tt.receiveCount, tt.base, tt.max)
+			if result != tt.expected {
+				t.Errorf("retryDelay() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReceiveCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		expected   int
+	}{
+		{
+			name:       "attribute present",
+			attributes: map[string]string{"ApproximateReceiveCount": "4"},
+			expected:   4,
+		},
+		{
+			name:       "attribute missing",
+			attributes: nil,
+			expected:   1,
+		},
+		{
+			name:       "attribute invalid",
+			attributes: map[string]string{"ApproximateReceiveCount": "many"},
+			expected:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := receiveCount(sqsTypes.Message{Attributes: tt.attributes})
+			if result != tt.expected {
+				t.Errorf("receiveCount() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name               string
+		policy             string
+		deadLetterQueueURL string
+		expectErr          bool
+	}{
+		{name: "delete", policy: "delete", expectErr: false},
+		{name: "quarantine", policy: "quarantine", expectErr: false},
+		{name: "dead-letter with queue", policy: "dead-letter", deadLetterQueueURL: "https://sqs/dlq", expectErr: false},
+		{name: "dead-letter without queue", policy: "dead-letter", expectErr: true},
+		{name: "unknown policy", policy: "ignore", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFailurePolicy(tt.policy, tt.deadLetterQueueURL)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateFailurePolicy() error = %v, expectErr %v", err, tt.expectErr)
+			}
+		})
+	}
+}
+
+// fakeFailureClient records the SQS calls made for a failed message as
+// "operation queue" strings.
+type fakeFailureClient struct {
+	calls      []string
+	visibility []int32
+	// failedRecipients is the FailedRecipients attribute of the last
+	// dead-lettered message.
+	failedRecipients string
+	sendErr          error
+}
+
+func (f *fakeFailureClient) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.calls = append(f.calls, "visibility "+Value(params.QueueUrl))
+	f.visibility = append(f.visibility, params.VisibilityTimeout)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeFailureClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.calls = append(f.calls, "delete "+Value(params.QueueUrl))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeFailureClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.calls = append(f.calls, "send "+Value(params.QueueUrl))
+	if f.sendErr != nil {
+		return nil, f.sendErr
+	}
+	if Value(params.MessageBody) != "body" || Value(params.MessageAttributes["SourceQueue"].StringValue) != "inbound" {
+		return nil, fmt.Errorf("unexpected dead-letter message %q from %q", Value(params.MessageBody), Value(params.MessageAttributes["SourceQueue"].StringValue))
+	}
+	f.failedRecipients = Value(params.MessageAttributes["FailedRecipients"].StringValue)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestFailureHandler(t *testing.T) {
+	tests := []struct {
+		name                     string
+		policy                   string
+		cause                    error
+		receiveCount             string
+		sendErr                  error
+		expectedCalls            []string
+		expectedVisibility       []int32
+		expectedFailedRecipients string
+	}{
+		{
+			name:               "retryable failure backs off",
+			policy:             failurePolicyDelete,
+			cause:              errors.New("connection refused"),
+			receiveCount:       "3",
+			expectedCalls:      []string{"visibility inbound"},
+			expectedVisibility: []int32{120},
+		},
+		{
+			name:          "delete",
+			policy:        failurePolicyDelete,
+			cause:         permanent(errors.New("malformed")),
+			expectedCalls: []string{"delete inbound"},
+		},
+		{
+			name:          "dead-letter",
+			policy:        failurePolicyDeadLetter,
+			cause:         permanent(errors.New("malformed")),
+			expectedCalls: []string{"send dead-letter", "delete inbound"},
+		},
+		{
+			name:          "failed dead-letter send leaves the message",
+			policy:        failurePolicyDeadLetter,
+			cause:         permanent(errors.New("malformed")),
+			sendErr:       errors.New("access denied"),
+			expectedCalls: []string{"send dead-letter"},
+		},
+		{
+			name:               "quarantine",
+			policy:             failurePolicyQuarantine,
+			cause:              permanent(errors.New("malformed")),
+			expectedCalls:      []string{"visibility inbound"},
+			expectedVisibility: []int32{int32(quarantineVisibility.Seconds())},
+		},
+		{
+			name:          "delivered message isn't quarantined",
+			policy:        failurePolicyQuarantine,
+			cause:         delivered(rejectedError(recipientErrors{"a@junk.tld": permanent(errRejected)})),
+			expectedCalls: []string{"delete inbound"},
+		},
+		{
+			name:                     "delivered message is dead-lettered for its failed recipients",
+			policy:                   failurePolicyDeadLetter,
+			cause:                    delivered(rejectedError(recipientErrors{"b@junk.tld": permanent(errRejected), "a@junk.tld": permanent(errRejected)})),
+			expectedCalls:            []string{"send dead-letter", "delete inbound"},
+			expectedFailedRecipients: "a@junk.tld,b@junk.tld",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeFailureClient{sendErr: tt.sendErr}
+			h := &failureHandler{
+				sqsClient:          client,
+				policy:             tt.policy,
+				deadLetterQueueURL: "dead-letter",
+				baseDelay:          30 * time.Second,
+				maxDelay:           time.Hour,
+			}
+			message := sqsTypes.Message{
+				MessageId:     aws.String("1"),
+				ReceiptHandle: aws.String("handle"),
+				Body:          aws.String("body"),
+				Attributes:    map[string]string{string(sqsTypes.MessageSystemAttributeNameApproximateReceiveCount): tt.receiveCount},
+			}
+
+			h.handle(context.Background(), slog.Default(), "inbound", message, tt.cause)
+			if !reflect.DeepEqual(client.calls, tt.expectedCalls) {
+				t.Errorf("handle() calls = %v, want %v", client.calls, tt.expectedCalls)
+			}
+			if !reflect.DeepEqual(client.visibility, tt.expectedVisibility) {
+				t.Errorf("handle() visibility timeouts = %v, want %v", client.visibility, tt.expectedVisibility)
+			}
+			if client.failedRecipients != tt.expectedFailedRecipients {
+				t.Errorf("handle() FailedRecipients = %q, want %q", client.failedRecipients, tt.expectedFailedRecipients)
+			}
+		})
+	}
+}
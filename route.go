@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// errNoRoute is returned for recipients that don't match any route when no
+// default route is configured.
+var errNoRoute = errors.New("no lmtp route for recipient")
+
+// newRoutes parses the endpoints of a routing table given as a map of match to
+// endpoints, as in the config file, where match is a domain or a full address.
+// The returned map is keyed by the lowercased match.
+func newRoutes(table map[string]stringList) (map[string][]endpoint, error) {
+	routes := make(map[string][]endpoint, len(table))
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		match := strings.ToLower(strings.TrimSpace(key))
+		if match == "" || strings.HasPrefix(match, "@") || strings.HasSuffix(match, "@") {
+			return nil, fmt.Errorf("invalid route %q: expected a domain or an address", key)
+		}
+		if _, ok := routes[match]; ok {
+			return nil, fmt.Errorf("invalid route %q: %q is routed more than once", key, match)
+		}
+		endpoints, err := parseEndpoints(strings.Join(table[key], ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %w", key, err)
+		}
+		routes[match] = endpoints
+	}
+	return routes, nil
+}
+
+// routedDeliverer sends each recipient to the Deliverer routed for its address
+// or domain. A message for recipients on several backends is delivered in one
+// transaction per backend.
+type routedDeliverer struct {
+	// routes maps a lowercased address or domain to its Deliverer. An address
+	// route takes precedence over a route for its domain.
+	routes map[string]Deliverer
+	// fallback receives recipients without a route. It may be nil.
+	fallback Deliverer
+}
+
+func newRoutedDeliverer(routes map[string]Deliverer, fallback Deliverer) *routedDeliverer {
+	return &routedDeliverer{routes: routes, fallback: fallback}
+}
+
+// route returns the Deliverer for rcpt, or nil if it has none.
+func (d *routedDeliverer) route(rcpt string) Deliverer {
+	if deliverer, ok := lookupRoute(d.routes, rcpt); ok {
+		return deliverer
+	}
+	return d.fallback
+}
+
+// lookupRoute returns the route for rcpt in a table keyed by lowercased
+// addresses and domains. An address route takes precedence over a route for
+// its domain.
+func lookupRoute[T any](routes map[string]T, rcpt string) (T, bool) {
+	address := strings.ToLower(rcpt)
+	if route, ok := routes[address]; ok {
+		return route, true
+	}
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		if route, ok := routes[address[i+1:]]; ok {
+			return route, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Deliver splits the recipients by route and delivers to each backend in turn.
+// The outcome of every backend is merged so that a retry only goes to the
+// recipients whose backend didn't accept the message.
+func (d *routedDeliverer) Deliver(ctx context.Context, envelope Envelope, body io.Reader) error {
+	var order []Deliverer
+	groups := make(map[Deliverer][]string)
+	rcptErrs := make(recipientErrors)
+	for _, rcpt := range envelope.Recipients {
+		deliverer := d.route(rcpt)
+		if deliverer == nil {
+			rcptErrs[rcpt] = permanent(fmt.Errorf("%w %s", errNoRoute, rcpt))
+			continue
+		}
+		if _, ok := groups[deliverer]; !ok {
+			order = append(order, deliverer)
+		}
+		groups[deliverer] = append(groups[deliverer], rcpt)
+	}
+
+	// A single backend is the common case and keeps its error as is
+	if len(order) == 1 && len(rcptErrs) == 0 {
+		return order[0].Deliver(ctx, envelope, body)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read message body: %w", err)
+	}
+
+	for _, deliverer := range order {
+		group := envelope
+		group.Recipients = groups[deliverer]
+		err := deliverer.Deliver(ctx, group, bytes.NewReader(data))
+		var groupErrs recipientErrors
+		switch {
+		case err == nil:
+		case errors.As(err, &groupErrs):
+			for rcpt, rcptErr := range groupErrs {
+				rcptErrs[rcpt] = rcptErr
+			}
+		default:
+			for _, rcpt := range group.Recipients {
+				rcptErrs[rcpt] = err
+			}
+		}
+	}
+
+	if len(rcptErrs) > 0 {
+		return rcptErrs
+	}
+	return nil
+}
+
+// Stats returns the state of the backends behind every route.
+func (d *routedDeliverer) Stats() []backendStats {
+	var stats []backendStats
+	for _, deliverer := range d.deliverers() {
+		if reporter, ok := deliverer.(backendReporter); ok {
+			stats = append(stats, reporter.Stats()...)
+		}
+	}
+	return stats
+}
+
+// Close closes every routed Deliverer that holds connections.
+func (d *routedDeliverer) Close() error {
+	var errs []error
+	for _, deliverer := range d.deliverers() {
+		if closer, ok := deliverer.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliverers returns each distinct Deliverer once, the fallback first.
+func (d *routedDeliverer) deliverers() []Deliverer {
+	var deliverers []Deliverer
+	seen := make(map[Deliverer]bool)
+	add := func(deliverer Deliverer) {
+		if deliverer != nil && !seen[deliverer] {
+			seen[deliverer] = true
+			deliverers = append(deliverers, deliverer)
+		}
+	}
+	add(d.fallback)
+	for _, match := range slices.Sorted(maps.Keys(d.routes)) {
+		add(d.routes[match])
+	}
+	return deliverers
+}
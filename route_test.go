@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingDeliverer records the recipients of every delivery and fails the
+// ones listed in errs.
+type recordingDeliverer struct {
+	mu    sync.Mutex
+	calls [][]string
+	err   error
+	errs  map[string]error
+}
+
+func (d *recordingDeliverer) Deliver(ctx context.Context, envelope Envelope, body io.Reader) error {
+	if _, err := io.ReadAll(body); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, envelope.Recipients)
+	if d.err != nil {
+		return d.err
+	}
+	rcptErrs := make(recipientErrors)
+	for _, rcpt := range envelope.Recipients {
+		if err := d.errs[rcpt]; err != nil {
+			rcptErrs[rcpt] = err
+		}
+	}
+	if len(rcptErrs) > 0 {
+		return rcptErrs
+	}
+	return nil
+}
+
+func TestNewRoutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string][]endpoint
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[string][]endpoint{},
+		},
+		{
+			name:  "domain and address routes",
+			input: "Example.com=tcp://mail1:24,tcp://mail2:24; ceo@example.com=unix:///run/dovecot/lmtp;",
+			expected: map[string][]endpoint{
+				"example.com": {
+					{network: "tcp", address: "mail1:24"},
+					{network: "tcp", address: "mail2:24"},
+				},
+				"ceo@example.com": {
+					{network: "unix", address: "/run/dovecot/lmtp"},
+				},
+			},
+		},
+		{
+			name:      "missing endpoints",
+			input:     "example.com",
+			expectErr: true,
+		},
+		{
+			name:      "invalid endpoint",
+			input:     "example.com=udp://mail1:24",
+			expectErr: true,
+		},
+		{
+			name:      "duplicate match",
+			input:     "example.com=mail1:24;EXAMPLE.com=mail2:24",
+			expectErr: true,
+		},
+		{
+			name:      "bare at sign",
+			input:     "@example.com=mail1:24",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Given as in LMTP_ROUTES
+			var result map[string][]endpoint
+			table, err := parseListMap(tt.input)
+			if err == nil {
+				result, err = newRoutes(table)
+			}
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("newRoutes() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("newRoutes() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRoutedDeliverer(t *testing.T) {
+	errRejected := errors.New("rejected")
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name       string
+		rcpts      []string
+		noFallback bool
+		domainErr  error
+		domainErrs map[string]error
+		expected   map[string][][]string
+		failed     []string
+	}{
+		{
+			name:  "single backend",
+			rcpts: []string{"a@example.com", "b@example.com"},
+			expected: map[string][][]string{
+				"domain": {{"a@example.com", "b@example.com"}},
+			},
+		},
+		{
+			name:  "split across backends",
+			rcpts: []string{"a@example.com", "CEO@example.com", "c@other.com", "b@example.com"},
+			expected: map[string][][]string{
+				"domain":   {{"a@example.com", "b@example.com"}},
+				"address":  {{"CEO@example.com"}},
+				"fallback": {{"c@other.com"}},
+			},
+		},
+		{
+			name:      "one backend down",
+			rcpts:     []string{"a@example.com", "c@other.com"},
+			domainErr: errDown,
+			expected: map[string][][]string{
+				"domain":   {{"a@example.com"}},
+				"fallback": {{"c@other.com"}},
+			},
+			failed: []string{"a@example.com"},
+		},
+		{
+			name:       "partial delivery on one backend",
+			rcpts:      []string{"a@example.com", "b@example.com", "c@other.com"},
+			domainErrs: map[string]error{"b@example.com": errRejected},
+			expected: map[string][][]string{
+				"domain":   {{"a@example.com", "b@example.com"}},
+				"fallback": {{"c@other.com"}},
+			},
+			failed: []string{"b@example.com"},
+		},
+		{
+			name:       "no route",
+			rcpts:      []string{"a@example.com", "c@other.com"},
+			noFallback: true,
+			expected: map[string][][]string{
+				"domain": {{"a@example.com"}},
+			},
+			failed: []string{"c@other.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deliverers := map[string]*recordingDeliverer{
+				"domain":   {err: tt.domainErr, errs: tt.domainErrs},
+				"address":  {},
+				"fallback": {},
+			}
+			var fallback Deliverer = deliverers["fallback"]
+			if tt.noFallback {
+				fallback = nil
+			}
+			routed := newRoutedDeliverer(map[string]Deliverer{
+				"example.com":     deliverers["domain"],
+				"ceo@example.com": deliverers["address"],
+			}, fallback)
+
+			err := routed.Deliver(context.Background(), Envelope{Recipients: tt.rcpts}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+
+			for name, deliverer := range deliverers {
+				if !reflect.DeepEqual(deliverer.calls, tt.expected[name]) {
+					t.Errorf("%s deliveries = %v, want %v", name, deliverer.calls, tt.expected[name])
+				}
+			}
+
+			if len(tt.failed) == 0 {
+				if err != nil {
+					t.Fatalf("Deliver() error = %v, want nil", err)
+				}
+				return
+			}
+			var rcptErrs recipientErrors
+			if !errors.As(err, &rcptErrs) {
+				t.Fatalf("Deliver() error = %v, want recipientErrors", err)
+			}
+			var failed []string
+			for _, rcpt := range tt.rcpts {
+				if rcptErrs[rcpt] != nil {
+					failed = append(failed, rcpt)
+				}
+			}
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("failed recipients = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+func TestRoutedDelivererNoRouteIsPermanent(t *testing.T) {
+	routed := newRoutedDeliverer(map[string]Deliverer{"example.com": &recordingDeliverer{}}, nil)
+
+	err := routed.Deliver(context.Background(), Envelope{Recipients: []string{"a@other.com"}}, strings.NewReader("hello"))
+	if !errors.Is(err, errNoRoute) {
+		t.Errorf("Deliver() error = %v, want %v", err, errNoRoute)
+	}
+	if isRetryable(err) {
+		t.Errorf("isRetryable(%v) = true, want false", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SNS signature verification modes
+	snsVerificationOff     = "off"
+	snsVerificationVerify  = "verify"
+	snsVerificationRequire = "require"
+)
+
+func validateSNSVerification(mode string) error {
+	switch mode {
+	case snsVerificationOff, snsVerificationVerify, snsVerificationRequire:
+		return nil
+	default:
+		return fmt.Errorf("unknown verification mode %q, expected one of %q, %q or %q", mode, snsVerificationOff, snsVerificationVerify, snsVerificationRequire)
+	}
+}
+
+// snsVerifier checks that SNS notifications were signed by SNS for one of our
+// topics, so that anyone else who can send to the queue can't make up
+// notifications pointing at arbitrary emails. SNS signs notifications for
+// every topic, including ones in an attacker's own account, so the signature
+// alone isn't enough.
+type snsVerifier struct {
+	// requireSigned rejects messages that aren't wrapped in an SNS
+	// notification, which can't be verified.
+	requireSigned bool
+	// topics are the topic ARNs notifications are accepted from.
+	topics map[string]bool
+	// client fetches the signing certificates. The certificates are trusted
+	// because they are served over TLS by SNS itself.
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+// newSNSVerifier returns a verifier for the given mode that accepts
+// notifications from topicArns, or nil if signatures aren't verified.
+func newSNSVerifier(mode string, topicArns []string) *snsVerifier {
+	if mode == snsVerificationOff {
+		return nil
+	}
+	topics := make(map[string]bool, len(topicArns))
+	for _, arn := range topicArns {
+		topics[arn] = true
+	}
+	return &snsVerifier{
+		requireSigned: mode == snsVerificationRequire,
+		topics:        topics,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		now:           time.Now,
+		certs:         make(map[string]*x509.Certificate),
+	}
+}
+
+// snsSignedMessage holds the fields of an SNS notification as they were
+// signed. events.SNSEntity parses the timestamp, which would lose its exact
+// formatting.
+type snsSignedMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+// Verify checks that the SNS notification in body comes from an accepted
+// topic and that its signature matches the certificate it names. A
+// certificate that can't be fetched is a transient error; every other failure
+// is permanent.
+func (v *snsVerifier) Verify(ctx context.Context, body []byte) error {
+	var entity snsSignedMessage
+	if err := json.Unmarshal(body, &entity); err != nil {
+		return permanent(fmt.Errorf("failed to unmarshal sns notification: %w", err))
+	}
+	// The topic is part of what SNS signs, so checking it before the
+	// signature is enough
+	if !v.topics[entity.TopicArn] {
+		return permanent(fmt.Errorf("sns notification from topic %q, which isn't in sns.topicArns", entity.TopicArn))
+	}
+
+	var hash crypto.Hash
+	switch entity.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	case "":
+		return permanent(errors.New("sns notification isn't signed"))
+	default:
+		return permanent(fmt.Errorf("unknown sns signature version %q", entity.SignatureVersion))
+	}
+	signature, err := base64.StdEncoding.DecodeString(entity.Signature)
+	if err != nil {
+		return permanent(fmt.Errorf("failed to decode sns signature: %w", err))
+	}
+
+	cert, err := v.certificate(ctx, entity.TopicArn, entity.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return permanent(errors.New("sns signing certificate doesn't have an rsa key"))
+	}
+
+	var digest []byte
+	if hash == crypto.SHA1 {
+		sum := sha1.Sum(snsStringToSign(entity))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(snsStringToSign(entity))
+		digest = sum[:]
+	}
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return permanent(fmt.Errorf("invalid sns signature: %w", err))
+	}
+	return nil
+}
+
+// snsStringToSign returns what SNS signs for a notification: the name and
+// value of each of its fields on separate lines, in a fixed order.
+func snsStringToSign(entity snsSignedMessage) []byte {
+	var b strings.Builder
+	field := func(name, value string) {
+		b.WriteString(name + "\n" + value + "\n")
+	}
+	field("Message", entity.Message)
+	field("MessageId", entity.MessageID)
+	if entity.Subject != "" {
+		field("Subject", entity.Subject)
+	}
+	field("Timestamp", entity.Timestamp)
+	field("TopicArn", entity.TopicArn)
+	field("Type", entity.Type)
+	return []byte(b.String())
+}
+
+// snsCertificateHost returns the host SNS serves the signing certificates for
+// topicArn from.
+func snsCertificateHost(topicArn string) (string, error) {
+	// arn:partition:sns:region:account:topic
+	parts := strings.Split(topicArn, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return "", fmt.Errorf("invalid sns topic arn %q", topicArn)
+	}
+	domain := "amazonaws.com"
+	if parts[1] == "aws-cn" {
+		domain = "amazonaws.com.cn"
+	}
+	return "sns." + parts[3] + "." + domain, nil
+}
+
+// certificate returns the signing certificate at certURL, which must be served
+// over https by SNS in the region of topicArn. Certificates are cached until
+// they expire.
+//
+// Only the host serving the certificate is checked, not the names in the
+// certificate itself: SNS signing certificates aren't necessarily issued for
+// the regional host they are served from.
+func (v *snsVerifier) certificate(ctx context.Context, topicArn, certURL string) (*x509.Certificate, error) {
+	host, err := snsCertificateHost(topicArn)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	u, err := url.Parse(certURL)
+	if err != nil || u.Scheme != "https" || u.Host != host || !strings.HasSuffix(u.Path, ".pem") {
+		return nil, permanent(fmt.Errorf("sns signing certificate url %q isn't a certificate served by %s", certURL, host))
+	}
+
+	now := v.now()
+	v.mu.Lock()
+	cert, ok := v.certs[certURL]
+	v.mu.Unlock()
+	if ok && now.Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	cert, err = v.fetchCertificate(ctx, certURL)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(cert.NotBefore) || !now.Before(cert.NotAfter) {
+		return nil, permanent(fmt.Errorf("sns signing certificate %q is only valid from %s to %s", certURL, cert.NotBefore, cert.NotAfter))
+	}
+	slog.Info("fetched sns signing certificate", "url", certURL, "subject", cert.Subject.String(), "notAfter", cert.NotAfter)
+
+	v.mu.Lock()
+	v.certs[certURL] = cert
+	v.mu.Unlock()
+	return cert, nil
+}
+
+// fetchCertificate downloads and parses the PEM certificate at certURL.
+func (v *snsVerifier) fetchCertificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to fetch sns signing certificate: %w", err))
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sns signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch sns signing certificate: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sns signing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, permanent(fmt.Errorf("sns signing certificate %q isn't a pem certificate", certURL))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("failed to parse sns signing certificate: %w", err))
+	}
+	return cert, nil
+}
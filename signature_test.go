@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	testTopicArn = "arn:aws:sns:us-east-1:123456789012:ses-inbound"
+	testCertURL  = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+)
+
+// snsFixture is a certificate authority standing in for the public ones,
+// with a TLS certificate for sns.us-east-1.amazonaws.com and an SNS signing
+// certificate. Like the real signing certificates, the signing certificate
+// isn't issued for the host serving it.
+type snsFixture struct {
+	roots   *x509.CertPool
+	tlsCert tls.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+}
+
+// newCertificate returns a certificate for template, issued by parent, or
+// self-signed if parent is nil.
+func newCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func newSNSFixture(t *testing.T) *snsFixture {
+	t.Helper()
+
+	ca, caKey := newCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	server, serverKey := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sns.us-east-1.amazonaws.com"},
+		DNSNames:     []string{"sns.us-east-1.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	signing, key := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &snsFixture{
+		roots:   roots,
+		tlsCert: tls.Certificate{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey},
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signing.Raw}),
+	}
+}
+
+// sign returns message as SNS would deliver it to SQS, signed with the given
+// signature version.
+func (f *snsFixture) sign(t *testing.T, message snsSignedMessage, version string) string {
+	t.Helper()
+
+	message.SignatureVersion = version
+	message.SigningCertURL = testCertURL
+	var signature []byte
+	var err error
+	if version == "1" {
+		sum := sha1.Sum(snsStringToSign(message))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA1, sum[:])
+	} else {
+		sum := sha256.Sum256(snsStringToSign(message))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, sum[:])
+	}
+	if err != nil {
+		t.Fatalf("failed to sign message: %v", err)
+	}
+	message.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	return string(body)
+}
+
+// serveTLS starts an https server using the fixture TLS certificate.
+func (f *snsFixture) serveTLS(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{f.tlsCert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serve starts a server for the fixture signing certificate that counts the
+// requests made to it.
+func (f *snsFixture) serve(t *testing.T, requests *int) *httptest.Server {
+	return f.serveTLS(t, func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if "https://"+r.Host+r.URL.Path != testCertURL {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(f.certPEM)
+	})
+}
+
+// verifier returns a verifier that accepts notifications from testTopicArn
+// and fetches every certificate from server, trusting only the fixture
+// authority.
+func (f *snsFixture) verifier(mode string, server *httptest.Server) *snsVerifier {
+	v := newSNSVerifier(mode, []string{testTopicArn})
+	v.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: f.roots},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+	return v
+}
+
+func TestSNSVerifier(t *testing.T) {
+	fixture := newSNSFixture(t)
+	other := newSNSFixture(t)
+	notification := snsSignedMessage{
+		Type:      "Notification",
+		MessageID: "sns-1",
+		TopicArn:  testTopicArn,
+		Subject:   "Amazon SES Email Receipt Notification",
+		Message:   `{"notificationType": "Received"}`,
+		Timestamp: "2024-01-01T12:00:00.100Z",
+	}
+	// modify returns the signed notification with one field of its JSON
+	// replaced after signing
+	modify := func(body, old, new string) string {
+		return strings.Replace(body, old, new, 1)
+	}
+	signed := fixture.sign(t, notification, "2")
+
+	tests := []struct {
+		name            string
+		body            string
+		served          *snsFixture
+		fetchStatus     int
+		expectErr       bool
+		expectRetryable bool
+	}{
+		{
+			name: "signature version 1",
+			body: fixture.sign(t, notification, "1"),
+		},
+		{
+			name: "signature version 2",
+			body: signed,
+		},
+		{
+			name: "no subject",
+			body: fixture.sign(t, snsSignedMessage{Type: "Notification", MessageID: "sns-2", TopicArn: testTopicArn, Message: "{}", Timestamp: "2024-01-01T12:00:00.000Z"}, "1"),
+		},
+		{
+			name:      "tampered message",
+			body:      modify(signed, `\"Received\"`, `\"Forged\"`),
+			expectErr: true,
+		},
+		{
+			name:      "tampered timestamp",
+			body:      modify(signed, "12:00:00.100Z", "12:00:00.1Z"),
+			expectErr: true,
+		},
+		{
+			name:      "unsigned",
+			body:      `{"Type": "Notification", "TopicArn": "` + testTopicArn + `", "Message": "{}"}`,
+			expectErr: true,
+		},
+		{
+			name: "topic that isn't accepted",
+			body: fixture.sign(t, snsSignedMessage{
+				Type:      "Notification",
+				MessageID: "sns-3",
+				TopicArn:  "arn:aws:sns:us-east-1:999999999999:ses-inbound",
+				Message:   notification.Message,
+				Timestamp: notification.Timestamp,
+			}, "2"),
+			expectErr: true,
+		},
+		{
+			name:      "tampered topic",
+			body:      modify(signed, "123456789012", "999999999999"),
+			expectErr: true,
+		},
+		{
+			name:      "unknown signature version",
+			body:      modify(signed, `"SignatureVersion":"2"`, `"SignatureVersion":"3"`),
+			expectErr: true,
+		},
+		{
+			name:      "certificate from another host",
+			body:      modify(signed, "https://sns.us-east-1.amazonaws.com/", "https://sns.us-east-1.amazonaws.com.evil.example/"),
+			expectErr: true,
+		},
+		{
+			name:      "certificate from another region",
+			body:      modify(signed, "https://sns.us-east-1.", "https://sns.eu-west-1."),
+			expectErr: true,
+		},
+		{
+			name:      "certificate over http",
+			body:      modify(signed, "https://", "http://"),
+			expectErr: true,
+		},
+		{
+			name:      "signed with another key",
+			body:      other.sign(t, notification, "2"),
+			expectErr: true,
+		},
+		{
+			// The signing certificate is only trusted because of who serves
+			// it, so it isn't used if that can't be checked
+			name:            "certificate served by an untrusted host",
+			body:            other.sign(t, notification, "2"),
+			served:          other,
+			expectErr:       true,
+			expectRetryable: true,
+		},
+		{
+			name:            "certificate can't be fetched",
+			body:            signed,
+			fetchStatus:     http.StatusServiceUnavailable,
+			expectErr:       true,
+			expectRetryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Certificates are served by the fixture the message was signed
+			// with, but only the first one is trusted
+			served := fixture
+			if tt.served != nil {
+				served = tt.served
+			}
+			var requests int
+			server := served.serve(t, &requests)
+			if tt.fetchStatus != 0 {
+				server = served.serveTLS(t, func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.fetchStatus)
+				})
+			}
+			v := fixture.verifier(snsVerificationVerify, server)
+
+			err := v.Verify(context.Background(), []byte(tt.body))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Verify() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.expectErr && isRetryable(err) != tt.expectRetryable {
+				t.Errorf("Verify() error = %v, retryable %v, want %v", err, isRetryable(err), tt.expectRetryable)
+			}
+		})
+	}
+}
+
+func TestSNSVerifierCachesCertificates(t *testing.T) {
+	fixture := newSNSFixture(t)
+	var requests int
+	v := fixture.verifier(snsVerificationVerify, fixture.serve(t, &requests))
+	body := fixture.sign(t, snsSignedMessage{Type: "Notification", MessageID: "sns-1", TopicArn: testTopicArn, Message: "{}", Timestamp: "2024-01-01T12:00:00.000Z"}, "2")
+
+	for range 3 {
+		if err := v.Verify(context.Background(), []byte(body)); err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("fetched certificate %d times, want %d", requests, 1)
+	}
+
+	// An expired certificate is fetched again, and rejected
+	v.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := v.Verify(context.Background(), []byte(body)); err == nil {
+		t.Errorf("Verify() error = nil for an expired certificate")
+	}
+	if requests != 2 {
+		t.Errorf("fetched certificate %d times, want %d", requests, 2)
+	}
+}
+
+func TestParsePayloadVerification(t *testing.T) {
+	fixture := newSNSFixture(t)
+	notification := sesActionNotification(`{"type": "S3", "bucketName": "mail", "objectKey": "inbound/a"}`, `""`)
+	signed := fixture.sign(t, snsSignedMessage{
+		Type:      "Notification",
+		MessageID: "sns-1",
+		TopicArn:  testTopicArn,
+		Message:   notification,
+		Timestamp: "2024-01-01T12:00:00.000Z",
+	}, "1")
+	message := func(body string) sqsTypes.Message {
+		return sqsTypes.Message{MessageId: aws.String("sqs-1"), Body: aws.String(body)}
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		message   sqsTypes.Message
+		expectErr bool
+	}{
+		{
+			name:    "signed notification",
+			mode:    snsVerificationVerify,
+			message: message(signed),
+		},
+		{
+			name:      "unsigned notification",
+			mode:      snsVerificationVerify,
+			message:   snsMessage(t, notification),
+			expectErr: true,
+		},
+		{
+			name:    "raw notification",
+			mode:    snsVerificationVerify,
+			message: message(notification),
+		},
+		{
+			name:    "signed notification when required",
+			mode:    snsVerificationRequire,
+			message: message(signed),
+		},
+		{
+			name:      "raw notification when required",
+			mode:      snsVerificationRequire,
+			message:   message(notification),
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			v := fixture.verifier(tt.mode, fixture.serve(t, &requests))
+
+			payload, err := parsePayload(context.Background(), tt.message, v)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parsePayload() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.expectErr && isRetryable(err) {
+				t.Errorf("parsePayload() error = %v, want a permanent error", err)
+			}
+			if !tt.expectErr && payload.notification == nil {
+				t.Errorf("parsePayload() notification = nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// smtpDeliverer relays messages to an SMTP smarthost such as Postfix or Exim.
+type smtpDeliverer struct {
+	host string
+	from string
+	opts clientOptions
+}
+
+// newSMTPDeliverer returns a Deliverer for the SMTP server at host. Messages
+// are sent with from as the MAIL FROM address, or with the envelope sender if
+// from is empty.
+func newSMTPDeliverer(host, from string, opts clientOptions) *smtpDeliverer {
+	opts.lmtp = false
+	return &smtpDeliverer{
+		host: host,
+		from: from,
+		opts: opts,
+	}
+}
+
+func (d *smtpDeliverer) Deliver(ctx context.Context, envelope Envelope, body io.Reader) error {
+	smtpClient, err := dialClient(ctx, "tcp", d.host, d.opts)
+	if err != nil {
+		return err
+	}
+
+	// Abort the transaction if the context is cancelled mid-delivery
+	stop := context.AfterFunc(ctx, func() {
+		_ = smtpClient.Close()
+	})
+	defer stop()
+	defer func() {
+		if err := smtpClient.Quit(); err != nil {
+			_ = smtpClient.Close()
+		}
+	}()
+
+	from := d.from
+	if from == "" {
+		from = envelope.From
+	}
+	return sendMail(smtpClient, false, from, envelope.Recipients, body)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and a
+// pool that trusts it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestSMTPDeliverer(t *testing.T) {
+	cert, roots := newTestCertificate(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientTLS := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	tests := []struct {
+		name      string
+		serverTLS *tls.Config
+		username  string
+		password  string
+		opts      clientOptions
+		expectErr bool
+		expectTLS bool
+	}{
+		{
+			name:      "plaintext",
+			opts:      clientOptions{heloName: "relay.example.com", tlsMode: tlsModeNone},
+			expectErr: false,
+			expectTLS: false,
+		},
+		{
+			name:      "opportunistic starttls offered",
+			serverTLS: serverTLS,
+			opts:      clientOptions{heloName: "relay.example.com", tlsMode: tlsModeOpportunistic, tlsConfig: clientTLS},
+			expectErr: false,
+			expectTLS: true,
+		},
+		{
+			name:      "opportunistic starttls not offered",
+			opts:      clientOptions{heloName: "relay.example.com", tlsMode: tlsModeOpportunistic, tlsConfig: clientTLS},
+			expectErr: false,
+			expectTLS: false,
+		},
+		{
+			name:      "required starttls not offered",
+			opts:      clientOptions{heloName: "relay.example.com", tlsMode: tlsModeRequired, tlsConfig: clientTLS},
+			expectErr: true,
+		},
+		{
+			name:      "required starttls with untrusted certificate",
+			serverTLS: serverTLS,
+			opts:      clientOptions{heloName: "relay.example.com", tlsMode: tlsModeRequired, tlsConfig: &tls.Config{ServerName: "127.0.0.1"}},
+			expectErr: true,
+		},
+		{
+			name:      "auth plain over starttls",
+			serverTLS: serverTLS,
+			username:  "user",
+			password:  "secret",
+			opts: clientOptions{
+				heloName:  "relay.example.com",
+				tlsMode:   tlsModeRequired,
+				tlsConfig: clientTLS,
+				auth:      func() sasl.Client { return sasl.NewPlainClient("", "user", "secret") },
+			},
+			expectErr: false,
+			expectTLS: true,
+		},
+		{
+			name:      "auth with wrong password",
+			serverTLS: serverTLS,
+			username:  "user",
+			password:  "secret",
+			opts: clientOptions{
+				heloName:  "relay.example.com",
+				tlsMode:   tlsModeRequired,
+				tlsConfig: clientTLS,
+				auth:      func() sasl.Client { return sasl.NewPlainClient("", "user", "wrong") },
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &testMailBackend{username: tt.username, password: tt.password}
+			addr := startTestMailServer(t, backend, false, tt.serverTLS)
+
+			deliverer := newSMTPDeliverer(addr, "from@example.com", tt.opts)
+			err := deliverer.Deliver(context.Background(), Envelope{Recipients: []string{"a@example.com"}}, strings.NewReader("Subject: test\r\n\r\nhello\r\n"))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Deliver() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if tt.expectErr {
+				if len(backend.deliveries("a@example.com")) != 0 {
+					t.Errorf("message was delivered despite error")
+				}
+				if isRetryable(err) != true {
+					t.Errorf("isRetryable() = false, want true for connection setup failures")
+				}
+				return
+			}
+
+			if len(backend.deliveries("a@example.com")) != 1 {
+				t.Errorf("deliveries = %d, want 1", len(backend.deliveries("a@example.com")))
+			}
+			last := len(backend.helloNames) - 1
+			if backend.helloNames[last] != "relay.example.com" {
+				t.Errorf("helo name = %q, want %q", backend.helloNames[last], "relay.example.com")
+			}
+			if backend.tlsStates[last] != tt.expectTLS {
+				t.Errorf("tls = %v, want %v", backend.tlsStates[last], tt.expectTLS)
+			}
+		})
+	}
+}
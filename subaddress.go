@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Subaddress modes
+	subaddressKeep   = "keep"
+	subaddressStrip  = "strip"
+	subaddressFolder = "folder"
+)
+
+// subaddressConfig describes how subaddresses such as user+detail@domain are
+// handled. The base address, user@domain, is what gets matched against
+// MAILBOXES and aliases; mode decides what is delivered:
+//
+//   - keep delivers the address as it was received
+//   - strip delivers the base address
+//   - folder delivers the base address with the detail replaced by the folder
+//     it maps to, for Dovecot's lmtp_save_to_detail_mailbox
+type subaddressConfig struct {
+	// delimiters holds the characters that separate the detail from the user,
+	// any of which may be used, as in Postfix and Dovecot.
+	delimiters string
+	mode       string
+	// folders maps a lowercased detail to the folder it is delivered to in
+	// folder mode. Details without a folder are delivered as they are.
+	folders map[string]string
+}
+
+// subaddress is the detail part of an address and the delimiter it was given
+// with.
+type subaddress struct {
+	delimiter string
+	detail    string
+}
+
+// split splits address into its base address and subaddress. It reports false
+// if address has no subaddress or subaddressing is disabled. It is safe to
+// call on a nil subaddressConfig.
+func (s *subaddressConfig) split(address string) (string, subaddress, bool) {
+	if s == nil || s.delimiters == "" {
+		return address, subaddress{}, false
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address, subaddress{}, false
+	}
+	local, domain := address[:at], address[at:]
+
+	// A leading delimiter is part of the user, not the start of a detail
+	i := strings.IndexAny(local, s.delimiters)
+	if i <= 0 {
+		return address, subaddress{}, false
+	}
+	return local[:i] + domain, subaddress{delimiter: local[i : i+1], detail: local[i+1:]}, true
+}
+
+// deliverTo returns the address to deliver to for a mailbox that was reached
+// through an address with subaddress sub.
+func (s *subaddressConfig) deliverTo(mailbox string, sub subaddress) string {
+	if s.mode == subaddressStrip {
+		return mailbox
+	}
+	// Alias targets with a detail of their own keep it
+	if _, _, ok := s.split(mailbox); ok {
+		return mailbox
+	}
+	at := strings.LastIndex(mailbox, "@")
+	if at < 0 {
+		return mailbox
+	}
+
+	detail := sub.detail
+	if s.mode == subaddressFolder {
+		if folder, ok := s.folders[strings.ToLower(detail)]; ok {
+			detail = folder
+		}
+	}
+	if detail == "" {
+		return mailbox
+	}
+	return mailbox[:at] + sub.delimiter + detail + mailbox[at:]
+}
+
+// parseSubaddressFolders parses a comma-separated list of detail=folder pairs,
+// e.g. newsletters=Lists/Newsletters,receipts=Receipts.
+func parseSubaddressFolders(s string) (map[string]string, error) {
+	folders := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		detail, folder, ok := strings.Cut(pair, "=")
+		detail, folder = strings.ToLower(strings.TrimSpace(detail)), strings.TrimSpace(folder)
+		if !ok || detail == "" || folder == "" {
+			return nil, fmt.Errorf("invalid folder mapping %q: expected detail=folder", strings.TrimSpace(pair))
+		}
+		folders[detail] = folder
+	}
+	return folders, nil
+}
+
+// validateSubaddressMode checks that mode is a known subaddress mode.
+func validateSubaddressMode(mode string) error {
+	switch mode {
+	case subaddressKeep, subaddressStrip, subaddressFolder:
+		return nil
+	default:
+		return fmt.Errorf("unknown subaddress mode %q, expected one of %q, %q or %q", mode, subaddressKeep, subaddressStrip, subaddressFolder)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubaddressConfigSplit(t *testing.T) {
+	config := &subaddressConfig{delimiters: "+-", mode: subaddressKeep}
+
+	tests := []struct {
+		name     string
+		config   *subaddressConfig
+		address  string
+		base     string
+		sub      subaddress
+		expected bool
+	}{
+		{
+			name:     "plus delimiter",
+			config:   config,
+			address:  "user+newsletters@example.com",
+			base:     "user@example.com",
+			sub:      subaddress{delimiter: "+", detail: "newsletters"},
+			expected: true,
+		},
+		{
+			name:     "first delimiter wins",
+			config:   config,
+			address:  "user-lists+go@example.com",
+			base:     "user@example.com",
+			sub:      subaddress{delimiter: "-", detail: "lists+go"},
+			expected: true,
+		},
+		{
+			name:     "empty detail",
+			config:   config,
+			address:  "user+@example.com",
+			base:     "user@example.com",
+			sub:      subaddress{delimiter: "+", detail: ""},
+			expected: true,
+		},
+		{
+			name:     "no subaddress",
+			config:   config,
+			address:  "user@example.com",
+			base:     "user@example.com",
+			expected: false,
+		},
+		{
+			name:     "leading delimiter",
+			config:   config,
+			address:  "+user@example.com",
+			base:     "+user@example.com",
+			expected: false,
+		},
+		{
+			name:     "disabled",
+			config:   nil,
+			address:  "user+newsletters@example.com",
+			base:     "user+newsletters@example.com",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, sub, ok := tt.config.split(tt.address)
+			if ok != tt.expected || base != tt.base || sub != tt.sub {
+				t.Errorf("split() = %v, %+v, %v, want %v, %+v, %v", base, sub, ok, tt.base, tt.sub, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSubaddressConfigDeliverTo(t *testing.T) {
+	sub := subaddress{delimiter: "+", detail: "Newsletters"}
+	folders := map[string]string{"newsletters": "Lists/Newsletters"}
+
+	tests := []struct {
+		name     string
+		mode     string
+		mailbox  string
+		sub      subaddress
+		expected string
+	}{
+		{
+			name:     "keep",
+			mode:     subaddressKeep,
+			mailbox:  "user@example.com",
+			sub:      sub,
+			expected: "user+Newsletters@example.com",
+		},
+		{
+			name:     "strip",
+			mode:     subaddressStrip,
+			mailbox:  "user@example.com",
+			sub:      sub,
+			expected: "user@example.com",
+		},
+		{
+			name:     "folder mapped",
+			mode:     subaddressFolder,
+			mailbox:  "user@example.com",
+			sub:      sub,
+			expected: "user+Lists/Newsletters@example.com",
+		},
+		{
+			name:     "folder unmapped",
+			mode:     subaddressFolder,
+			mailbox:  "user@example.com",
+			sub:      subaddress{delimiter: "+", detail: "receipts"},
+			expected: "user+receipts@example.com",
+		},
+		{
+			name:     "empty detail",
+			mode:     subaddressKeep,
+			mailbox:  "user@example.com",
+			sub:      subaddress{delimiter: "+"},
+			expected: "user@example.com",
+		},
+		{
+			name:     "mailbox with its own detail",
+			mode:     subaddressKeep,
+			mailbox:  "user+inbox@example.com",
+			sub:      sub,
+			expected: "user+inbox@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &subaddressConfig{delimiters: "+", mode: tt.mode, folders: folders}
+			if result := config.deliverTo(tt.mailbox, tt.sub); result != tt.expected {
+				t.Errorf("deliverTo() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseSubaddressFolders(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			expected: map[string]string{},
+		},
+		{
+			name:  "mappings",
+			input: "Newsletters=Lists/Newsletters, receipts=Receipts",
+			expected: map[string]string{
+				"newsletters": "Lists/Newsletters",
+				"receipts":    "Receipts",
+			},
+		},
+		{
+			name:      "missing folder",
+			input:     "newsletters=",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseSubaddressFolders(tt.input)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parseSubaddressFolders() error = %v, expectErr %v", err, tt.expectErr)
+			}
+			if !tt.expectErr && !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("parseSubaddressFolders() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateSubaddressMode(t *testing.T) {
+	for _, mode := range []string{subaddressKeep, subaddressStrip, subaddressFolder} {
+		if err := validateSubaddressMode(mode); err != nil {
+			t.Errorf("validateSubaddressMode(%q) error = %v", mode, err)
+		}
+	}
+	if err := validateSubaddressMode("drop"); err == nil {
+		t.Errorf("validateSubaddressMode(%q) error = nil, want an error", "drop")
+	}
+}
@@ -1,27 +1,5 @@
 package main
 
-import (
-	"fmt"
-	"os"
-)
-
-func Check(err error, msg string) {
-	if err != nil {
-		panic(fmt.Sprintf("%s: %v", msg, err))
-	}
-}
-
-func MustGetEnv(key string, fallback *string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		if fallback != nil {
-			return *fallback
-		}
-		panic(fmt.Sprintf("environment variable %q is required", key))
-	}
-	return value
-}
-
 func Pointer[T any](v T) *T {
 	return &v
 }
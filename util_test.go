@@ -1,9 +1,6 @@
 package main
 
 import (
-	"errors"
-	"fmt"
-	"os"
 	"strings"
 	"testing"
 )
@@ -416,123 +413,3 @@ func TestContainsInts(t *testing.T) {
 		})
 	}
 }
-
-func TestMustGetEnv(t *testing.T) {
-	tests := []struct {
-		name        string
-		key         string
-		envValue    string
-		fallback    *string
-		expected    string
-		shouldPanic bool
-	}{
-		{
-			name:        "existing environment variable",
-			key:         "TEST_EXISTING",
-			envValue:    "test_value",
-			fallback:    nil,
-			expected:    "test_value",
-			shouldPanic: false,
-		},
-		{
-			name:        "missing env with fallback",
-			key:         "TEST_MISSING_WITH_FALLBACK",
-			envValue:    "",
-			fallback:    Pointer("fallback_value"),
-			expected:    "fallback_value",
-			shouldPanic: false,
-		},
-		{
-			name:        "missing env without fallback should panic",
-			key:         "TEST_MISSING_NO_FALLBACK",
-			envValue:    "",
-			fallback:    nil,
-			expected:    "",
-			shouldPanic: true,
-		},
-		{
-			name:        "empty env with fallback",
-			key:         "TEST_EMPTY_WITH_FALLBACK",
-			envValue:    "",
-			fallback:    Pointer("default_value"),
-			expected:    "default_value",
-			shouldPanic: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Set up environment
-			if tt.envValue != "" {
-				os.Setenv(tt.key, tt.envValue)
-				defer os.Unsetenv(tt.key)
-			} else {
-				os.Unsetenv(tt.key)
-			}
-
-			if tt.shouldPanic {
-				defer func() {
-					if r := recover(); r == nil {
-						t.Errorf("MustGetEnv() should have panicked")
-					} else {
-						// Verify the panic message contains the expected key
-						panicMsg := fmt.Sprintf("%v", r)
-						if !strings.Contains(panicMsg, tt.key) {
-							t.Errorf("Panic message should contain key %q, got: %v", tt.key, panicMsg)
-						}
-					}
-				}()
-				MustGetEnv(tt.key, tt.fallback)
-			} else {
-				result := MustGetEnv(tt.key, tt.fallback)
-				if result != tt.expected {
-					t.Errorf("MustGetEnv() = %v, want %v", result, tt.expected)
-				}
-			}
-		})
-	}
-}
-
-func TestCheck(t *testing.T) {
-	tests := []struct {
-		name        string
-		err         error
-		msg         string
-		shouldPanic bool
-	}{
-		{
-			name:        "no error",
-			err:         nil,
-			msg:         "test message",
-			shouldPanic: false,
-		},
-		{
-			name:        "with error should panic",
-			err:         errors.New("test error"),
-			msg:         "test message",
-			shouldPanic: true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if tt.shouldPanic {
-				defer func() {
-					if r := recover(); r == nil {
-						t.Errorf("Check() should have panicked")
-					} else {
-						// Verify the panic message contains the expected message and error
-						panicMsg := fmt.Sprintf("%v", r)
-						if !strings.Contains(panicMsg, tt.msg) {
-							t.Errorf("Panic message should contain %q, got: %v", tt.msg, panicMsg)
-						}
-						if !strings.Contains(panicMsg, tt.err.Error()) {
-							t.Errorf("Panic message should contain error %q, got: %v", tt.err.Error(), panicMsg)
-						}
-					}
-				}()
-			}
-			Check(tt.err, tt.msg)
-		})
-	}
-}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// workerPool runs jobs on a fixed number of goroutines. Submit blocks until a
+// worker is free, which bounds the number of jobs in flight to the pool size.
+type workerPool[T any] struct {
+	jobs   chan T
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newWorkerPool starts size workers that call handler for every submitted job.
+// Each job gets its own context, derived from a pool context that is only
+// cancelled when Drain gives up waiting, so shutdown signals don't interrupt
+// in-flight work.
+func newWorkerPool[T any](size int, handler func(ctx context.Context, job T)) *workerPool[T] {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &workerPool[T]{
+		jobs:   make(chan T),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for i := 0; i < size; i++ {
+		p.wg.Add(1)
+		go func(id int) {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				jobCtx, cancel := context.WithCancel(p.ctx)
+				handler(jobCtx, job)
+				cancel()
+			}
+			slog.Debug("worker stopped", "worker", id)
+		}(i)
+	}
+
+	return p
+}
+
+// Submit hands job to the next free worker. It returns ctx.Err() if ctx is
+// done before a worker accepts the job.
+func (p *workerPool[T]) Submit(ctx context.Context, job T) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain stops accepting jobs and waits for in-flight jobs to finish. If they
+// don't finish within timeout their contexts are cancelled and Drain waits for
+// the handlers to return. It reports whether all jobs finished in time.
+// Submit must not be called after Drain.
+func (p *workerPool[T]) Drain(timeout time.Duration) bool {
+	close(p.jobs)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	defer p.cancel()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		p.cancel()
+		<-done
+		return false
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	const size = 3
+
+	var running, maxRunning atomic.Int32
+	release := make(chan struct{})
+	pool := newWorkerPool(size, func(ctx context.Context, job int) {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := pool.Submit(context.Background(), i); err != nil {
+				t.Errorf("Submit() error = %v", err)
+			}
+		}
+	}()
+
+	// Let the workers fill up, then release them one job at a time.
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		release <- struct{}{}
+	}
+	wg.Wait()
+
+	if !pool.Drain(time.Second) {
+		t.Errorf("Drain() = false, want true")
+	}
+	if got := maxRunning.Load(); got != size {
+		t.Errorf("max concurrent jobs = %v, want %v", got, size)
+	}
+}
+
+func TestWorkerPoolSubmitCancelled(t *testing.T) {
+	block := make(chan struct{})
+	pool := newWorkerPool(1, func(ctx context.Context, job int) {
+		<-block
+	})
+
+	if err := pool.Submit(context.Background(), 1); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Submit(ctx, 2); err != context.DeadlineExceeded {
+		t.Errorf("Submit() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(block)
+	pool.Drain(time.Second)
+}
+
+func TestWorkerPoolDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		jobTime   time.Duration
+		timeout   time.Duration
+		expected  bool
+		cancelled bool
+	}{
+		{
+			name:      "jobs finish before timeout",
+			jobTime:   10 * time.Millisecond,
+			timeout:   time.Second,
+			expected:  true,
+			cancelled: false,
+		},
+		{
+			name:      "jobs cancelled after timeout",
+			jobTime:   time.Minute,
+			timeout:   20 * time.Millisecond,
+			expected:  false,
+			cancelled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cancelled atomic.Bool
+			started := make(chan struct{})
+			pool := newWorkerPool(1, func(ctx context.Context, job int) {
+				close(started)
+				select {
+				case <-time.After(tt.jobTime):
+				case <-ctx.Done():
+					cancelled.Store(true)
+				}
+			})
+
+			if err := pool.Submit(context.Background(), 1); err != nil {
+				t.Fatalf("Submit() error = %v", err)
+			}
+			<-started
+
+			if result := pool.Drain(tt.timeout); result != tt.expected {
+				t.Errorf("Drain() = %v, want %v", result, tt.expected)
+			}
+			if cancelled.Load() != tt.cancelled {
+				t.Errorf("job cancelled = %v, want %v", cancelled.Load(), tt.cancelled)
+			}
+		})
+	}
+}